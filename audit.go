@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultAuditLogPath = "audit.log"
+
+// auditLog appends security events to a file, one JSON object per
+// line. Events are only ever added, never rewritten.
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+type auditEvent struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	UserID    int       `json:"user_id,omitempty"`
+	SessionID int       `json:"session_id,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// events recorded in the audit log
+const (
+	// a rotated refresh token was presented again, its session closed
+	auditRefreshTokenReuse = "refresh_token_reuse"
+)
+
+func openAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: file}, nil
+}
+
+// record event as caused by r, stamping it with the current time
+func (a *auditLog) record(r *http.Request, event auditEvent) {
+	client := sessionClient(r)
+	event.Time = time.Now().UTC()
+	event.IP = client.IP
+	event.UserAgent = client.UserAgent
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Cannot encode audit event %s: %v", event.Event, err)
+		return
+	}
+	log.Printf("audit: %s", line)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Cannot write audit log: %v", err)
+	}
+}
+
+func (a *auditLog) Close() error {
+	return a.file.Close()
+}
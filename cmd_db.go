@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/hale-pretty/chirpy/database"
+	"github.com/joho/godotenv"
+)
+
+const defaultDBPath = "database.json"
+
+// runDBCommand runs `chirpy db <command>` and returns the exit code
+func runDBCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: chirpy db <migrate|export|import|check|convert> [flags]")
+		return 2
+	}
+	// the database key may live in .env next to JWT_SECRET
+	godotenv.Load()
+	switch args[0] {
+	case "migrate":
+		return runMigrateCommand(args[1:])
+	case "export":
+		return runExportCommand(args[1:])
+	case "import":
+		return runImportCommand(args[1:])
+	case "check":
+		return runCheckCommand(args[1:])
+	case "convert":
+		return runConvertCommand(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown db command %q\n", args[0])
+		return 2
+	}
+}
+
+func runMigrateCommand(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	path := flags.String("db", defaultDBPath, "path to the database file")
+	dryRun := flags.Bool("dry-run", false, "only report the migrations that would apply")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	opts, err := databaseOptionsFromEnv()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	pending, err := database.PendingMigrations(*path, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read database: %v\n", err)
+		return 1
+	}
+	if len(pending) == 0 {
+		fmt.Println("Database is up to date")
+		return 0
+	}
+	for _, m := range pending {
+		fmt.Printf("%d: %s\n", m.Version, m.Description)
+	}
+	if *dryRun {
+		fmt.Printf("%d migration(s) would apply\n", len(pending))
+		return 0
+	}
+
+	// NewDB runs the pending migrations and writes the migrated snapshot
+	db, err := database.NewDBWithOptions(*path, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Migration failed: %v\n", err)
+		return 1
+	}
+	if err := db.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Migration failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%d migration(s) applied\n", len(pending))
+	return 0
+}
+
+// open the database at path with the options from the environment
+func openDBFromEnv(path string) (*database.DB, error) {
+	opts, err := databaseOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return database.NewDBWithOptions(path, opts)
+}
+
+func runExportCommand(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	path := flags.String("db", defaultDBPath, "path to the database file")
+	output := flags.String("o", "-", "file to write the NDJSON export to, - for stdout")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	db, err := openDBFromEnv(*path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot open database: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.OpenFile(*output, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot create export: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := db.Export(w); err != nil {
+		fmt.Fprintf(os.Stderr, "Export failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func runImportCommand(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	path := flags.String("db", defaultDBPath, "path to the database file")
+	mode := flags.String("mode", string(database.ImportMerge), "merge into the existing data or replace it")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "usage: chirpy db import [flags] [file]")
+		return 2
+	}
+
+	var r io.Reader = os.Stdin
+	if input := flags.Arg(0); input != "" && input != "-" {
+		f, err := os.Open(input)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot open import: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+
+	db, err := openDBFromEnv(*path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot open database: %v\n", err)
+		return 1
+	}
+	result, err := db.Import(r, database.ImportMode(*mode))
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Import failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Imported %d user(s), %d chirp(s) and %d membership(s)\n", result.Users, result.Chirps, result.Memberships)
+	fmt.Printf("%d user(s) merged by email, %d user ID(s) and %d chirp ID(s) remapped\n", result.MergedUsers, result.RemappedUsers, result.RemappedChirps)
+	if result.SkippedChirps > 0 {
+		fmt.Printf("%d chirp(s) skipped, already imported\n", result.SkippedChirps)
+	}
+	return 0
+}
+
+func runCheckCommand(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	path := flags.String("db", defaultDBPath, "path to the database file")
+	repair := flags.Bool("repair", false, "fix the problems that can be fixed safely")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	var problems []database.Problem
+	if *repair {
+		// opening the database migrates it, so repairs apply to the
+		// current schema
+		db, err := openDBFromEnv(*path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot open database: %v\n", err)
+			return 1
+		}
+		problems, err = db.Repair()
+		if closeErr := db.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Check failed: %v\n", err)
+			return 1
+		}
+	} else {
+		// a plain check reads the files and leaves them as they are
+		opts, err := databaseOptionsFromEnv()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		problems, err = database.CheckFile(*path, opts)
+		if errors.Is(err, database.ErrMigrationsPending) {
+			fmt.Fprintf(os.Stderr, "Check failed: %v, run chirpy db migrate or check -repair first\n", err)
+			return 1
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Check failed: %v\n", err)
+			return 1
+		}
+	}
+
+	repaired, remaining := 0, 0
+	for _, p := range problems {
+		if *repair && p.Repairable {
+			fmt.Printf("repaired: %s\n", p)
+			repaired++
+			continue
+		}
+		if p.Repairable {
+			fmt.Printf("%s (repairable with -repair)\n", p)
+		} else {
+			fmt.Println(p)
+		}
+		remaining++
+	}
+	if repaired > 0 {
+		fmt.Printf("%d problem(s) repaired\n", repaired)
+	}
+	if remaining > 0 {
+		fmt.Printf("%d problem(s) found\n", remaining)
+		return 1
+	}
+	if repaired == 0 {
+		fmt.Println("No problems found")
+	}
+	return 0
+}
+
+func runConvertCommand(args []string) int {
+	flags := flag.NewFlagSet("convert", flag.ContinueOnError)
+	path := flags.String("db", defaultDBPath, "path to the database file")
+	to := flags.String("to", "", "format to convert to, json or binary")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	format, err := database.ParseSnapshotFormat(*to)
+	if err != nil || *to == "" {
+		fmt.Fprintln(os.Stderr, "usage: chirpy db convert -to <json|binary> [-db path]")
+		return 2
+	}
+
+	opts, err := databaseOptionsFromEnv()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// NewDB rewrites a file that is not in opts.Format
+	configured := opts.Format
+	opts.Format = format
+	db, err := database.NewDBWithOptions(*path, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Conversion failed: %v\n", err)
+		return 1
+	}
+	if err := db.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Conversion failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%s is stored as %s\n", *path, format)
+	if configured != format {
+		fmt.Printf("Set CHIRPY_DB_FORMAT=%s, or the server converts it back on start\n", format)
+	}
+	return 0
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hale-pretty/chirpy/database"
+	"github.com/hale-pretty/chirpy/internal/auth"
+)
+
+// read the database options from the environment
+func databaseOptionsFromEnv() (database.Options, error) {
+	opts := database.Options{}
+	if window := os.Getenv("CHIRPY_COMMIT_WINDOW"); window != "" {
+		d, err := time.ParseDuration(window)
+		if err != nil {
+			return opts, fmt.Errorf("invalid CHIRPY_COMMIT_WINDOW: %w", err)
+		}
+		opts.CommitWindow = d
+	}
+	if maxBatch := os.Getenv("CHIRPY_COMMIT_MAX_BATCH"); maxBatch != "" {
+		n, err := strconv.Atoi(maxBatch)
+		if err != nil {
+			return opts, fmt.Errorf("invalid CHIRPY_COMMIT_MAX_BATCH: %w", err)
+		}
+		opts.CommitMaxBatch = n
+	}
+	// CHIRPY_DB_KEY is a base64 encoded 32 byte key; after rotating it,
+	// list the previous keys in CHIRPY_DB_OLD_KEYS (comma separated)
+	// until the next start has re-encrypted the files
+	if key := os.Getenv("CHIRPY_DB_KEY"); key != "" {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return opts, fmt.Errorf("invalid CHIRPY_DB_KEY: %w", err)
+		}
+		opts.EncryptionKey = decoded
+	}
+	if oldKeys := os.Getenv("CHIRPY_DB_OLD_KEYS"); oldKeys != "" {
+		for _, key := range strings.Split(oldKeys, ",") {
+			decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+			if err != nil {
+				return opts, fmt.Errorf("invalid CHIRPY_DB_OLD_KEYS: %w", err)
+			}
+			opts.OldEncryptionKeys = append(opts.OldEncryptionKeys, decoded)
+		}
+	}
+	// set CHIRPY_DB_ENCRYPT_PLAINTEXT=true for the one start that
+	// encrypts an unencrypted database with a new CHIRPY_DB_KEY
+	if encrypt := os.Getenv("CHIRPY_DB_ENCRYPT_PLAINTEXT"); encrypt != "" {
+		b, err := strconv.ParseBool(encrypt)
+		if err != nil {
+			return opts, fmt.Errorf("invalid CHIRPY_DB_ENCRYPT_PLAINTEXT: %w", err)
+		}
+		opts.EncryptPlaintext = b
+	}
+	// CHIRPY_DB_FORMAT is json (the default) or binary
+	format, err := database.ParseSnapshotFormat(os.Getenv("CHIRPY_DB_FORMAT"))
+	if err != nil {
+		return opts, fmt.Errorf("invalid CHIRPY_DB_FORMAT: %w", err)
+	}
+	opts.Format = format
+	// CHIRPY_BACKUP_DIR enables scheduled backups into that directory
+	opts.BackupDir = os.Getenv("CHIRPY_BACKUP_DIR")
+	if interval := os.Getenv("CHIRPY_BACKUP_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return opts, fmt.Errorf("invalid CHIRPY_BACKUP_INTERVAL: %w", err)
+		}
+		opts.BackupInterval = d
+	}
+	if keep := os.Getenv("CHIRPY_BACKUP_KEEP_HOURLY"); keep != "" {
+		n, err := strconv.Atoi(keep)
+		if err != nil {
+			return opts, fmt.Errorf("invalid CHIRPY_BACKUP_KEEP_HOURLY: %w", err)
+		}
+		opts.BackupKeepHourly = n
+	}
+	if keep := os.Getenv("CHIRPY_BACKUP_KEEP_DAILY"); keep != "" {
+		n, err := strconv.Atoi(keep)
+		if err != nil {
+			return opts, fmt.Errorf("invalid CHIRPY_BACKUP_KEEP_DAILY: %w", err)
+		}
+		opts.BackupKeepDaily = n
+	}
+	// the change feed keeps changes for CHIRPY_CHANGE_RETENTION, but
+	// no more than CHIRPY_CHANGE_RETENTION_MAX of them
+	if retention := os.Getenv("CHIRPY_CHANGE_RETENTION"); retention != "" {
+		d, err := time.ParseDuration(retention)
+		if err != nil {
+			return opts, fmt.Errorf("invalid CHIRPY_CHANGE_RETENTION: %w", err)
+		}
+		opts.ChangeRetention = d
+	}
+	if retentionMax := os.Getenv("CHIRPY_CHANGE_RETENTION_MAX"); retentionMax != "" {
+		n, err := strconv.Atoi(retentionMax)
+		if err != nil {
+			return opts, fmt.Errorf("invalid CHIRPY_CHANGE_RETENTION_MAX: %w", err)
+		}
+		opts.ChangeRetentionMax = n
+	}
+	// chirp tombstones are purged once CHIRPY_RETAIN_DELETED_CHIRPS
+	// old and sessions once unused for CHIRPY_RETAIN_IDLE_SESSIONS,
+	// checked every CHIRPY_RETENTION_INTERVAL
+	if retain := os.Getenv("CHIRPY_RETAIN_DELETED_CHIRPS"); retain != "" {
+		d, err := time.ParseDuration(retain)
+		if err != nil {
+			return opts, fmt.Errorf("invalid CHIRPY_RETAIN_DELETED_CHIRPS: %w", err)
+		}
+		opts.Retention.ChirpTombstones = d
+	}
+	if retain := os.Getenv("CHIRPY_RETAIN_IDLE_SESSIONS"); retain != "" {
+		d, err := time.ParseDuration(retain)
+		if err != nil {
+			return opts, fmt.Errorf("invalid CHIRPY_RETAIN_IDLE_SESSIONS: %w", err)
+		}
+		opts.Retention.IdleSessions = d
+	}
+	if interval := os.Getenv("CHIRPY_RETENTION_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return opts, fmt.Errorf("invalid CHIRPY_RETENTION_INTERVAL: %w", err)
+		}
+		opts.RetentionInterval = d
+	}
+	return opts, nil
+}
+
+// read how long refresh tokens last from CHIRPY_REFRESH_TOKEN_TTL,
+// database.DefaultRefreshTokenTTL if unset
+func refreshTokenTTLFromEnv() (time.Duration, error) {
+	ttl := os.Getenv("CHIRPY_REFRESH_TOKEN_TTL")
+	if ttl == "" {
+		return database.DefaultRefreshTokenTTL, nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		return 0, fmt.Errorf("invalid CHIRPY_REFRESH_TOKEN_TTL: %w", err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid CHIRPY_REFRESH_TOKEN_TTL: must be positive")
+	}
+	return d, nil
+}
+
+// load the access token keys from the directory CHIRPY_JWT_KEYS, signing
+// with CHIRPY_JWT_ACTIVE_KID, or sign with JWT_SECRET if it is unset.
+// Next to the keys, tokens signed with JWT_SECRET are rejected unless
+// CHIRPY_JWT_ACCEPT_HS256 keeps accepting them for a while.
+func jwtKeyringFromEnv() (*auth.Keyring, error) {
+	dir := os.Getenv("CHIRPY_JWT_KEYS")
+	secret := os.Getenv("JWT_SECRET")
+	if dir == "" && secret == "" {
+		return nil, fmt.Errorf("JWT_SECRET or CHIRPY_JWT_KEYS environment variable is not set")
+	}
+	secretUntil, err := acceptHS256FromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if !secretUntil.IsZero() && (dir == "" || secret == "") {
+		return nil, fmt.Errorf("invalid CHIRPY_JWT_ACCEPT_HS256: needs both CHIRPY_JWT_KEYS and JWT_SECRET")
+	}
+	return auth.LoadKeyring(dir, os.Getenv("CHIRPY_JWT_ACTIVE_KID"), secret, secretUntil)
+}
+
+// read until when tokens signed with JWT_SECRET stay valid after
+// switching to keys from CHIRPY_JWT_ACCEPT_HS256=until:<RFC 3339 time>,
+// the zero time if unset
+func acceptHS256FromEnv() (time.Time, error) {
+	accept := os.Getenv("CHIRPY_JWT_ACCEPT_HS256")
+	if accept == "" {
+		return time.Time{}, nil
+	}
+	until, ok := strings.CutPrefix(accept, "until:")
+	if !ok {
+		return time.Time{}, fmt.Errorf("invalid CHIRPY_JWT_ACCEPT_HS256: want until:<RFC 3339 time>")
+	}
+	t, err := time.Parse(time.RFC3339, until)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid CHIRPY_JWT_ACCEPT_HS256: %w", err)
+	}
+	return t, nil
+}
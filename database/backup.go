@@ -0,0 +1,216 @@
+package database
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultBackupInterval   = time.Hour
+	defaultBackupKeepHourly = 24
+	defaultBackupKeepDaily  = 7
+)
+
+// UTC time layout in the names of scheduled backups
+const backupTimeLayout = "20060102T150405Z"
+
+// backupSchedule writes timestamped backups into dir every interval
+// and prunes them down to the newest backup of each of the last
+// keepHourly hours and keepDaily days
+type backupSchedule struct {
+	dir        string
+	interval   time.Duration
+	keepHourly int
+	keepDaily  int
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// a backup file found in the backup directory
+type scheduledBackup struct {
+	path  string
+	taken time.Time
+}
+
+func newBackupSchedule(opts Options) *backupSchedule {
+	if opts.BackupDir == "" {
+		return nil
+	}
+	schedule := &backupSchedule{
+		dir:        opts.BackupDir,
+		interval:   opts.BackupInterval,
+		keepHourly: opts.BackupKeepHourly,
+		keepDaily:  opts.BackupKeepDaily,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	if schedule.interval <= 0 {
+		schedule.interval = defaultBackupInterval
+	}
+	if schedule.keepHourly == 0 {
+		schedule.keepHourly = defaultBackupKeepHourly
+	}
+	if schedule.keepDaily == 0 {
+		schedule.keepDaily = defaultBackupKeepDaily
+	}
+	return schedule
+}
+
+// Backup writes a consistent snapshot of the database to w. It is
+// taken under the read lock and has the format of the database file,
+// encryption included, so restoring means passing it to Restore, or
+// putting it in place of the database file and removing the log while
+// the server is stopped.
+func (db *DB) Backup(w io.Writer) error {
+	snapshot, err := db.encodeBackup()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(snapshot)
+	return err
+}
+
+func (db *DB) encodeBackup() ([]byte, error) {
+	var snapshot []byte
+	err := db.View(func(tx *Tx) error {
+		var err error
+		snapshot, err = encodeSnapshot(tx.db.data, tx.db.format, tx.db.keys)
+		return err
+	})
+	return snapshot, err
+}
+
+// write a scheduled backup now and prune the expired ones,
+// returning the path of the new backup
+func (db *DB) backupNow(now time.Time) (string, error) {
+	if err := db.fsys.MkdirAll(db.schedule.dir, 0700); err != nil {
+		return "", err
+	}
+	snapshot, err := db.encodeBackup()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(db.schedule.dir, db.backupName(now))
+	if err := writeFileAtomic(db.fsys, path, snapshot, 0); err != nil {
+		return "", err
+	}
+	return path, db.pruneBackups()
+}
+
+// name of the backup taken at now: database-20240102T150405Z.json
+// for the database file database.json
+func (db *DB) backupName(now time.Time) string {
+	prefix, ext := db.backupNameParts()
+	return prefix + now.UTC().Format(backupTimeLayout) + ext
+}
+
+func (db *DB) backupNameParts() (prefix, ext string) {
+	base := filepath.Base(db.path)
+	ext = filepath.Ext(base)
+	return strings.TrimSuffix(base, ext) + "-", ext
+}
+
+// scheduled backups in the backup directory, newest first
+func (db *DB) listBackups() ([]scheduledBackup, error) {
+	entries, err := db.fsys.ReadDir(db.schedule.dir)
+	if err != nil {
+		return nil, err
+	}
+	prefix, ext := db.backupNameParts()
+	backups := []scheduledBackup{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)
+		taken, err := time.Parse(backupTimeLayout, stamp)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, scheduledBackup{path: filepath.Join(db.schedule.dir, name), taken: taken})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].taken.After(backups[j].taken) })
+	return backups, nil
+}
+
+// delete the backups no retention rule keeps
+func (db *DB) pruneBackups() error {
+	backups, err := db.listBackups()
+	if err != nil {
+		return err
+	}
+	errs := []error{}
+	for _, backup := range expiredBackups(backups, db.schedule.keepHourly, db.schedule.keepDaily) {
+		if err := db.fsys.Remove(backup.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// expiredBackups returns the backups, sorted newest first, that are
+// neither the newest of one of the last keepHourly hours nor of one of
+// the last keepDaily days that have backups. The newest backup is
+// always kept.
+func expiredBackups(backups []scheduledBackup, keepHourly, keepDaily int) []scheduledBackup {
+	hours := make(map[string]struct{})
+	days := make(map[string]struct{})
+	expired := []scheduledBackup{}
+	for i, backup := range backups {
+		keep := i == 0
+		hour := backup.taken.Format("2006010215")
+		if _, ok := hours[hour]; !ok && len(hours) < keepHourly {
+			hours[hour] = struct{}{}
+			keep = true
+		}
+		day := backup.taken.Format("20060102")
+		if _, ok := days[day]; !ok && len(days) < keepDaily {
+			days[day] = struct{}{}
+			keep = true
+		}
+		if !keep {
+			expired = append(expired, backup)
+		}
+	}
+	return expired
+}
+
+// runBackups writes a backup every interval until Close
+func (db *DB) runBackups() {
+	defer close(db.schedule.done)
+	ticker := time.NewTicker(db.schedule.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.schedule.stop:
+			return
+		case now := <-ticker.C:
+			path, err := db.backupNow(now)
+			if err != nil {
+				log.Printf("database: scheduled backup failed: %v", err)
+				continue
+			}
+			log.Printf("database: wrote backup %s", path)
+		}
+	}
+}
+
+// stop the backup scheduler and wait for a running backup to finish
+func (db *DB) stopBackups() {
+	if db.schedule == nil {
+		return
+	}
+	select {
+	case <-db.schedule.stop:
+	default:
+		close(db.schedule.stop)
+	}
+	<-db.schedule.done
+}
@@ -0,0 +1,365 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrChangesExpired = errors.New("changes are no longer retained")
+
+const (
+	defaultChangeRetention    = 24 * time.Hour
+	defaultChangeRetentionMax = 10000
+	// most changes returned by one Changes call
+	maxChangesPage = 1000
+)
+
+// ChangeType says what a change did to its record
+type ChangeType string
+
+const (
+	ChangeCreated ChangeType = "created"
+	ChangeUpdated ChangeType = "updated"
+	ChangeDeleted ChangeType = "deleted"
+)
+
+// Change is one mutation in the change feed. Seq numbers the changes
+// without gaps in the order they were committed, across restarts.
+type Change struct {
+	Seq        int64      `json:"seq"`
+	Type       ChangeType `json:"type"`
+	Collection string     `json:"collection"`
+	ID         int        `json:"id"`
+	// the record after the change, absent for deletions
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// ChangePage is a slice of the change feed returned by Changes
+type ChangePage struct {
+	Changes []Change `json:"changes"`
+	// seq of the newest change in the feed, the consumer is caught up
+	// once it has seen it
+	Latest int64 `json:"latest"`
+}
+
+// fields holding secrets, by collection, left out of redacted changes
+var secretFields = map[string][]string{
+	collectionUsers:    {"password"},
+	collectionSessions: {"token_hash", "rotated_token_hashes"},
+}
+
+// Redacted returns the page without password hashes and refresh token
+// hashes, for consumers that only follow the data. Replicas need the
+// full values to serve logins and refreshes.
+func (page ChangePage) Redacted() ChangePage {
+	redacted := ChangePage{Changes: make([]Change, len(page.Changes)), Latest: page.Latest}
+	for i, change := range page.Changes {
+		redacted.Changes[i] = change.redacted()
+	}
+	return redacted
+}
+
+func (change Change) redacted() Change {
+	fields := secretFields[change.Collection]
+	if len(fields) == 0 || change.Value == nil {
+		return change
+	}
+	value := map[string]json.RawMessage{}
+	if err := json.Unmarshal(change.Value, &value); err != nil {
+		// never pass on what could not be checked
+		change.Value = nil
+		return change
+	}
+	for _, field := range fields {
+		delete(value, field)
+	}
+	change.Value, _ = json.Marshal(value)
+	return change
+}
+
+// changeFeed keeps the changes flushed to the log for a while, so that
+// consumers can follow the database and resume where they stopped.
+// Changes are only published once durable and never twice.
+type changeFeed struct {
+	mu sync.Mutex
+	// oldest first
+	changes []retainedChange
+	// every change after floor is retained
+	floor        int64
+	latest       int64
+	retention    time.Duration
+	retentionMax int
+	// closed and replaced whenever changes are published
+	notify chan struct{}
+	closed bool
+}
+
+type retainedChange struct {
+	Change
+	Published time.Time `json:"published"`
+}
+
+// retainedChanges is what the changes file holds: the feed as of the
+// last compaction, whose log records went with it
+type retainedChanges struct {
+	Floor   int64            `json:"floor"`
+	Changes []retainedChange `json:"changes"`
+}
+
+// the file the feed is kept in between compactions and restarts
+func changesPath(path string) string {
+	return path + ".changes"
+}
+
+func newChangeFeed(opts Options) *changeFeed {
+	feed := &changeFeed{
+		retention:    opts.ChangeRetention,
+		retentionMax: opts.ChangeRetentionMax,
+		notify:       make(chan struct{}),
+	}
+	if feed.retention <= 0 {
+		feed.retention = defaultChangeRetention
+	}
+	if feed.retentionMax <= 0 {
+		feed.retentionMax = defaultChangeRetentionMax
+	}
+	return feed
+}
+
+// the changes of the put and delete records of one transaction
+func changesFromRecords(records []logRecord) []Change {
+	changes := []Change{}
+	for _, record := range records {
+		if record.Seq == 0 {
+			continue
+		}
+		change := Change{
+			Seq:        record.Seq,
+			Collection: record.Collection,
+			ID:         record.ID,
+		}
+		switch {
+		case record.Op == opDelete:
+			change.Type = ChangeDeleted
+		case record.Created:
+			change.Type = ChangeCreated
+			change.Value = record.Value
+		default:
+			change.Type = ChangeUpdated
+			change.Value = record.Value
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// start the feed with the changes a previous run retained, those up
+// to latest, if nothing was published yet
+func (f *changeFeed) restore(stored retainedChanges, latest int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.latest != 0 || len(f.changes) > 0 || stored.Floor > latest {
+		return
+	}
+	f.floor = stored.Floor
+	f.latest = stored.Floor
+	for _, change := range stored.Changes {
+		if change.Seq <= f.latest || change.Seq > latest {
+			continue
+		}
+		f.changes = append(f.changes, change)
+		f.latest = change.Seq
+	}
+}
+
+// start the feed after floor unless it already reaches floor, then
+// publish changes, which log replay found
+func (f *changeFeed) load(floor int64, changes []Change) {
+	f.mu.Lock()
+	if f.latest < floor || (f.latest == 0 && len(f.changes) == 0) {
+		// the changes between would be missing
+		f.changes = nil
+		f.floor = floor
+		f.latest = floor
+	}
+	f.mu.Unlock()
+	f.publish(changes)
+}
+
+// the changes still within the retention window
+func (f *changeFeed) retained() retainedChanges {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.prune(time.Now())
+	return retainedChanges{Floor: f.floor, Changes: append([]retainedChange{}, f.changes...)}
+}
+
+// append changes the feed does not hold yet and wake the waiters
+func (f *changeFeed) publish(changes []Change) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	published := false
+	for _, change := range changes {
+		if change.Seq <= f.latest {
+			continue
+		}
+		f.changes = append(f.changes, retainedChange{Change: change, Published: now})
+		f.latest = change.Seq
+		published = true
+	}
+	f.prune(now)
+	if published && !f.closed {
+		close(f.notify)
+		f.notify = make(chan struct{})
+	}
+}
+
+// drop the changes beyond the retention window
+func (f *changeFeed) prune(now time.Time) {
+	n := 0
+	for n < len(f.changes) {
+		if len(f.changes)-n <= f.retentionMax && now.Sub(f.changes[n].Published) <= f.retention {
+			break
+		}
+		f.floor = f.changes[n].Seq
+		n++
+	}
+	f.changes = f.changes[n:]
+}
+
+func (f *changeFeed) page(since int64, limit int) (ChangePage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.prune(time.Now())
+	if since < f.floor {
+		return ChangePage{}, ErrChangesExpired
+	}
+	first := sort.Search(len(f.changes), func(i int) bool { return f.changes[i].Seq > since })
+	last := min(len(f.changes), first+limit)
+	page := ChangePage{Changes: make([]Change, 0, last-first), Latest: f.latest}
+	for _, retained := range f.changes[first:last] {
+		page.Changes = append(page.Changes, retained.Change)
+	}
+	return page, nil
+}
+
+// wait until there are changes after since, the feed closes or ctx is
+// done
+func (f *changeFeed) wait(ctx context.Context, since int64) error {
+	for {
+		f.mu.Lock()
+		latest, closed, notify := f.latest, f.closed, f.notify
+		f.mu.Unlock()
+		if latest > since {
+			return nil
+		}
+		if closed {
+			return ErrClosed
+		}
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// drop every change and continue after floor
+func (f *changeFeed) reset(floor int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.changes = nil
+	f.floor = floor
+	f.latest = floor
+	if !f.closed {
+		close(f.notify)
+		f.notify = make(chan struct{})
+	}
+}
+
+func (f *changeFeed) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.closed {
+		f.closed = true
+		close(f.notify)
+	}
+}
+
+// Changes returns up to limit changes committed after since, oldest
+// first. A consumer starts from the change_seq of a backup, or from 0
+// on a new database, and passes the Seq of the last change it
+// processed. ErrChangesExpired means changes after since were dropped
+// from the retention window and the consumer has to start over from a
+// new backup.
+func (db *DB) Changes(since int64, limit int) (ChangePage, error) {
+	if limit <= 0 || limit > maxChangesPage {
+		limit = maxChangesPage
+	}
+	return db.feed.page(since, limit)
+}
+
+// WaitForChanges blocks until changes after since have been committed,
+// returning ctx.Err() if ctx is done first and ErrClosed once the
+// database closes
+func (db *DB) WaitForChanges(ctx context.Context, since int64) error {
+	return db.feed.wait(ctx, since)
+}
+
+// raise DB.data.ChangeSeq to the seq of the newest of records
+func (db *DB) raiseChangeSeq(records []logRecord) {
+	db.seqMux.Lock()
+	defer db.seqMux.Unlock()
+	for _, record := range records {
+		db.data.ChangeSeq = max(db.data.ChangeSeq, record.Seq)
+	}
+}
+
+// write the retained changes to the changes file, so that the feed
+// outlives the log records it was built from
+func (db *DB) writeRetainedChanges() error {
+	raw, err := encodeSnapshotFile(snapshotFile{Layout: layoutChanges}, db.feed.retained(), db.format, db.keys)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(db.fsys, changesPath(db.path), raw, 0)
+}
+
+// read the changes file, which is dropped if it is missing, unreadable
+// or of an older schema version, whose values the feed cannot serve
+func readRetainedChanges(fsys FS, path string, keys *keyring) (retainedChanges, bool) {
+	stored := retainedChanges{}
+	snapshot, err := readSnapshot(fsys, changesPath(path), keys)
+	if errors.Is(err, os.ErrNotExist) {
+		return stored, false
+	}
+	if err == nil && snapshot.Layout != layoutChanges {
+		err = fmt.Errorf("%s: not a changes file", changesPath(path))
+	}
+	if err == nil && snapshot.Version == currentVersion() {
+		err = snapshot.decode(&stored)
+	}
+	if err != nil {
+		log.Printf("database: change feed starts over: %v", err)
+		return stored, false
+	}
+	return stored, snapshot.Version == currentVersion()
+}
+
+// remove the changes file, which describes a history the database no
+// longer continues
+func removeRetainedChanges(fsys FS, path string) error {
+	err := fsys.Remove(changesPath(path))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedactedChangesHoldNoSecrets(t *testing.T) {
+	db := openTestDB(t, NewMemFS(), Options{})
+	user, err := db.CreateUser("user@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Hour)
+	if _, err := db.CreateSession(user.ID, "token", expires, SessionClient{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.RotateRefreshToken("token", "rotated", expires); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateChirp("hello", user.ID); err != nil {
+		t.Fatal(err)
+	}
+	page, err := db.Changes(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secrets := []string{`"password"`, `"token_hash"`, `"rotated_token_hashes"`}
+	encode := func(page ChangePage) string {
+		raw, err := json.Marshal(page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(raw)
+	}
+	full := encode(page)
+	for _, secret := range secrets {
+		if !strings.Contains(full, secret) {
+			t.Errorf("full feed lacks %s, replicas need it", secret)
+		}
+	}
+	redacted := page.Redacted()
+	for _, secret := range secrets {
+		if strings.Contains(encode(redacted), secret) {
+			t.Errorf("redacted feed holds %s", secret)
+		}
+	}
+	if len(redacted.Changes) != len(page.Changes) || redacted.Latest != page.Latest {
+		t.Errorf("redacted page has %d changes up to %d, want %d up to %d",
+			len(redacted.Changes), redacted.Latest, len(page.Changes), page.Latest)
+	}
+	for _, change := range redacted.Changes {
+		if change.Type != ChangeDeleted && change.Value == nil {
+			t.Errorf("change %d lost its value", change.Seq)
+		}
+	}
+	if !strings.Contains(encode(redacted), `"hello"`) {
+		t.Error("redacted feed lacks the chirp")
+	}
+}
+
+func TestChangesResumeAfterReopen(t *testing.T) {
+	fsys := NewMemFS()
+	db := openTestDB(t, fsys, Options{})
+	user, err := db.CreateUser("user@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	since := db.ChangeSeq()
+	reopen := func() {
+		t.Helper()
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db = openTestDB(t, fsys, Options{})
+	}
+	want := []string{}
+	for restart := 1; restart <= 2; restart++ {
+		body := fmt.Sprintf("before restart %d", restart)
+		if _, err := db.CreateChirp(body, user.ID); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, body)
+		reopen()
+	}
+
+	page, err := db.Changes(since, 0)
+	if err != nil {
+		t.Fatalf("Changes(%d) after restarts = %v", since, err)
+	}
+	got := []string{}
+	for _, change := range page.Changes {
+		chirp := Chirp{}
+		if err := json.Unmarshal(change.Value, &chirp); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, chirp.Body)
+	}
+	if !reflect.DeepEqual(got, want) || page.Latest != db.ChangeSeq() {
+		t.Errorf("Changes(%d) = %v up to %d, want %v up to %d", since, got, page.Latest, want, db.ChangeSeq())
+	}
+	if _, err := db.Changes(0, 0); err != nil {
+		t.Errorf("Changes(0) = %v, the whole feed is within the retention window", err)
+	}
+}
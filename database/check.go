@@ -0,0 +1,310 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrMigrationsPending = errors.New("database has pending migrations")
+
+// Problem is a referential or uniqueness violation found by Check
+type Problem struct {
+	Collection string `json:"collection"`
+	ID         int    `json:"id"`
+	Message    string `json:"message"`
+	// whether Repair fixes the problem
+	Repairable bool `json:"repairable"`
+	fix        func(tx *Tx) error
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s %d: %s", p.Collection, p.ID, p.Message)
+}
+
+// Check reports every integrity problem in the database without
+// changing anything
+func (db *DB) Check() ([]Problem, error) {
+	problems := []Problem{}
+	err := db.View(func(tx *Tx) error {
+		problems = findProblems(tx.db.data)
+		return nil
+	})
+	return problems, err
+}
+
+// CheckFile reports every integrity problem in the database at path
+// like Check, without opening it: the snapshot and the log are read
+// into memory, and nothing is migrated, compacted or written. A
+// database at an older schema version fails with ErrMigrationsPending,
+// it has to be migrated first.
+func CheckFile(path string, opts Options) ([]Problem, error) {
+	keys, err := optionsKeyring(opts)
+	if err != nil {
+		return nil, err
+	}
+	fsys := opts.FS
+	if fsys == nil {
+		fsys = OSFS{}
+	}
+	// a process with the database open could compact it mid-read
+	lock, err := acquireReadLock(fsys, path)
+	if err != nil {
+		return nil, err
+	}
+	if lock != nil {
+		defer lock.Close()
+	}
+	// no fallback to backups, a corrupt snapshot is what a check is for
+	stored, err := readStored(fsys, path, path, keys)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := pendingMigrations(stored.manifest.Version)
+	if err != nil {
+		return nil, err
+	}
+	if len(pending) > 0 {
+		return nil, fmt.Errorf("%w: schema version %d, current is %d", ErrMigrationsPending, stored.manifest.Version, currentVersion())
+	}
+	data, err := stored.decodeData()
+	if err != nil {
+		return nil, err
+	}
+	_, err = replayLog(fsys, logPath(path), data.apply, keys, false)
+	if err != nil {
+		return nil, fmt.Errorf("cannot replay log: %w", err)
+	}
+	return findProblems(data), nil
+}
+
+// Repair fixes the problems that can be fixed without losing data in a
+// single transaction and returns every problem found, repaired or not.
+// Orphaned and empty chirps become tombstones, records stored under
+// the wrong key get their key as ID, orphaned sessions and sessions
+// sharing a refresh token are closed and sequences are raised past the
+// highest ID. Duplicate emails are left for an operator to resolve.
+func (db *DB) Repair() ([]Problem, error) {
+	problems := []Problem{}
+	err := db.Update(func(tx *Tx) error {
+		problems = findProblems(tx.db.data)
+		for _, p := range problems {
+			if !p.Repairable {
+				continue
+			}
+			if err := p.fix(tx); err != nil {
+				return fmt.Errorf("cannot repair %s: %w", p, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return problems, nil
+}
+
+func findProblems(data *DbData) []Problem {
+	problems := []Problem{}
+	problems = append(problems, userProblems(data)...)
+	problems = append(problems, chirpProblems(data)...)
+	problems = append(problems, sessionProblems(data)...)
+	problems = append(problems, sequenceProblems(data)...)
+	return problems
+}
+
+func userProblems(data *DbData) []Problem {
+	problems := []Problem{}
+	emails := make(map[string][]int)
+	for _, key := range sortedKeys(data.Users) {
+		user := data.Users[key]
+		if user.ID != key {
+			problems = append(problems, Problem{
+				Collection: collectionUsers,
+				ID:         key,
+				Message:    fmt.Sprintf("stored under id %d but has id %d", key, user.ID),
+				Repairable: true,
+				fix: func(tx *Tx) error {
+					user, _ := tx.User(key)
+					user.ID = key
+					return tx.PutUser(user)
+				},
+			})
+		}
+		if user.Email == "" {
+			problems = append(problems, Problem{
+				Collection: collectionUsers,
+				ID:         key,
+				Message:    "has no email",
+			})
+		} else {
+			email := NormalizeEmail(user.Email)
+			emails[email] = append(emails[email], key)
+		}
+	}
+
+	for _, email := range sortedStrings(emails) {
+		ids := emails[email]
+		// stored before emails were normalized
+		if user := data.Users[ids[0]]; len(ids) == 1 && user.Email != email {
+			problems = append(problems, Problem{
+				Collection: collectionUsers,
+				ID:         ids[0],
+				Message:    fmt.Sprintf("email %q is not normalized", user.Email),
+				Repairable: true,
+				fix: func(tx *Tx) error {
+					user, _ := tx.User(ids[0])
+					user.Email = NormalizeEmail(user.Email)
+					return tx.PutUser(user)
+				},
+			})
+		}
+		// the oldest user is the one that can log in with the email
+		for _, id := range ids[1:] {
+			problems = append(problems, Problem{
+				Collection: collectionUsers,
+				ID:         id,
+				Message:    fmt.Sprintf("email %q is also used by user %d", email, ids[0]),
+			})
+		}
+	}
+	return problems
+}
+
+func chirpProblems(data *DbData) []Problem {
+	problems := []Problem{}
+	for _, key := range sortedKeys(data.Chirps) {
+		chirp := data.Chirps[key]
+		if chirp.ID != key {
+			problems = append(problems, Problem{
+				Collection: collectionChirps,
+				ID:         key,
+				Message:    fmt.Sprintf("stored under id %d but has id %d", key, chirp.ID),
+				Repairable: true,
+				fix: func(tx *Tx) error {
+					chirp, _ := tx.Chirp(key)
+					chirp.ID = key
+					return tx.PutChirp(chirp)
+				},
+			})
+		}
+		// tombstones are never served, whatever they point at
+		if chirp.IsDeleted() {
+			continue
+		}
+		message := ""
+		if chirp.Body == "" && chirp.AuthorID == 0 {
+			message = "is empty but not a tombstone"
+		} else if _, ok := data.Users[chirp.AuthorID]; !ok {
+			message = fmt.Sprintf("author %d does not exist", chirp.AuthorID)
+		}
+		if message == "" {
+			continue
+		}
+		problems = append(problems, Problem{
+			Collection: collectionChirps,
+			ID:         key,
+			Message:    message,
+			Repairable: true,
+			fix: func(tx *Tx) error {
+				chirp, _ := tx.Chirp(key)
+				chirp.ID = key
+				deletedAt := time.Now().UTC()
+				chirp.DeletedAt = &deletedAt
+				return tx.PutChirp(chirp)
+			},
+		})
+	}
+	return problems
+}
+
+func sessionProblems(data *DbData) []Problem {
+	problems := []Problem{}
+	hashes := make(map[string][]int)
+	for _, key := range sortedKeys(data.Sessions) {
+		session := data.Sessions[key]
+		if session.ID != key {
+			problems = append(problems, Problem{
+				Collection: collectionSessions,
+				ID:         key,
+				Message:    fmt.Sprintf("stored under id %d but has id %d", key, session.ID),
+				Repairable: true,
+				fix: func(tx *Tx) error {
+					session, _ := tx.Session(key)
+					session.ID = key
+					return tx.PutSession(session)
+				},
+			})
+		}
+		if _, ok := data.Users[session.UserID]; !ok {
+			problems = append(problems, Problem{
+				Collection: collectionSessions,
+				ID:         key,
+				Message:    fmt.Sprintf("user %d does not exist", session.UserID),
+				Repairable: true,
+				fix: func(tx *Tx) error {
+					return tx.DeleteSession(key)
+				},
+			})
+			continue
+		}
+		hashes[session.TokenHash] = append(hashes[session.TokenHash], key)
+	}
+
+	for _, hash := range sortedStrings(hashes) {
+		ids := hashes[hash]
+		if len(ids) < 2 {
+			continue
+		}
+		problems = append(problems, Problem{
+			Collection: collectionSessions,
+			ID:         ids[0],
+			Message:    fmt.Sprintf("refresh token is shared by sessions %s", joinInts(ids)),
+			Repairable: true,
+			fix: func(tx *Tx) error {
+				for _, id := range ids {
+					if err := tx.DeleteSession(id); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		})
+	}
+	return problems
+}
+
+func sequenceProblems(data *DbData) []Problem {
+	problems := []Problem{}
+	highest := map[string]int{
+		collectionUsers:    maxKey(data.Users),
+		collectionChirps:   maxKey(data.Chirps),
+		collectionSessions: maxKey(data.Sessions),
+	}
+	for _, collection := range collections {
+		seq := data.Sequences[collection]
+		if seq >= highest[collection] {
+			continue
+		}
+		problems = append(problems, Problem{
+			Collection: collection,
+			ID:         highest[collection],
+			Message:    fmt.Sprintf("id is above the sequence %d", seq),
+			Repairable: true,
+			fix: func(tx *Tx) error {
+				tx.bumpSequence(collection, highest[collection])
+				return nil
+			},
+		})
+	}
+	return problems
+}
+
+func joinInts(ids []int) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = fmt.Sprint(id)
+	}
+	return strings.Join(parts, ", ")
+}
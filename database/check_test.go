@@ -0,0 +1,77 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+// fail every operation that changes the files
+func failWrites(op Op) *Fault {
+	switch op.Kind {
+	case OpCreateTemp, OpRename, OpLink, OpRemove, OpChmod, OpMkdirAll,
+		OpSyncDir, OpWrite, OpSync, OpTruncate:
+		return &Fault{}
+	}
+	return nil
+}
+
+func TestCheckFileIsReadOnly(t *testing.T) {
+	fsys := NewFaultFS(NewMemFS())
+	db := openTestDB(t, fsys, Options{})
+	user, err := db.CreateUser("user@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateChirp("orphan", user.ID+1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// a crash in the middle of an append left a torn record
+	f, err := fsys.OpenFile(logPath("/data/database.json"), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(`{"seq":`)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	fsys.SetInjector(failWrites)
+	problems, err := CheckFile("/data/database.json", Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].Collection != collectionChirps {
+		t.Errorf("CheckFile = %v, want the orphaned chirp", problems)
+	}
+	if failed := fsys.Failed(); len(failed) > 0 {
+		t.Errorf("CheckFile tried to write: %v", failed)
+	}
+}
+
+func TestCheckFileRefusesPendingMigrations(t *testing.T) {
+	fsys := NewFaultFS(NewMemFS())
+	if err := fsys.MkdirAll("/data", 0700); err != nil {
+		t.Fatal(err)
+	}
+	// a database file from before the schema was versioned
+	f, err := fsys.OpenFile("/data/database.json", os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(`{"chirps":{},"users":{}}`)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	fsys.SetInjector(failWrites)
+	if _, err := CheckFile("/data/database.json", Options{FS: fsys}); !errors.Is(err, ErrMigrationsPending) {
+		t.Errorf("CheckFile = %v, want ErrMigrationsPending", err)
+	}
+	if failed := fsys.Failed(); len(failed) > 0 {
+		t.Errorf("CheckFile tried to write: %v", failed)
+	}
+}
@@ -1,42 +1,95 @@
 package database
 
-import "errors"
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+var ErrDeleted = errors.New("resource has been deleted")
+
+var ErrNotAuthor = errors.New("cannot delete chirps of others")
+
+// longest chirp body in bytes, for the API and imports alike
+const MaxChirpLength = 140
+
+// ChirpTooLong reports whether body is longer than MaxChirpLength
+func ChirpTooLong(body string) bool {
+	return len(body) > MaxChirpLength
+}
 
 // create new Chirp and write new DB.data to disk
 func (db *DB) CreateChirp(msg string, authorID int) (Chirp, error) {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-	newChirp := Chirp{
-		ID:       len(db.Data.Chirps) + 1,
-		Body:     msg,
-		AuthorID: authorID,
-	}
-	db.Data.Chirps[newChirp.ID] = newChirp
-	err := db.writeDBtoDisk()
+	newChirp := Chirp{}
+	err := db.update([]string{collectionChirps}, func(tx *Tx) error {
+		var err error
+		newChirp, err = tx.InsertChirp(Chirp{
+			Body:     msg,
+			AuthorID: authorID,
+		})
+		return err
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
 	return newChirp, nil
 }
 
+// soft-delete a chirp, leaving a tombstone with deleted_at set
 func (db *DB) DeleteChirp(authorID, chirpID int) error {
-	for id, chirp := range db.Data.Chirps {
-		if chirp.AuthorID != authorID {
-			return errors.New("cannot delete chirps of others")
+	return db.update([]string{collectionChirps}, func(tx *Tx) error {
+		chirp, ok := tx.Chirp(chirpID)
+		if !ok {
+			return ErrNotExist
 		}
-		if id == chirpID {
-			db.Data.Chirps[id] = Chirp{}
-			return nil
+		if chirp.IsDeleted() {
+			return ErrDeleted
 		}
-	}
-	return errors.New("chirp not found")
+		if chirp.AuthorID != authorID {
+			return ErrNotAuthor
+		}
+		deletedAt := time.Now().UTC()
+		chirp.DeletedAt = &deletedAt
+		return tx.PutChirp(chirp)
+	})
 }
 
 func (db *DB) GetChirpByChirpId(chirpID int) (Chirp, error) {
-	for id, chirp := range db.Data.Chirps {
-		if id != chirpID {
-			return chirp, nil
+	chirp := Chirp{}
+	err := db.view([]string{collectionChirps}, func(tx *Tx) error {
+		var ok bool
+		chirp, ok = tx.Chirp(chirpID)
+		if !ok {
+			return ErrNotExist
 		}
-	}
-	return Chirp{}, ErrNotExist
+		if chirp.IsDeleted() {
+			return ErrDeleted
+		}
+		return nil
+	})
+	return chirp, err
+}
+
+// get all chirps ordered by ID
+func (db *DB) GetChirps() []Chirp {
+	chirps := []Chirp{}
+	db.view([]string{collectionChirps}, func(tx *Tx) error {
+		chirps = tx.Chirps()
+		return nil
+	})
+	return chirps
+}
+
+// get the chirps of one author ordered by ID
+func (db *DB) GetChirpsByAuthor(authorID int) []Chirp {
+	chirps := []Chirp{}
+	db.view([]string{collectionChirps}, func(tx *Tx) error {
+		chirps = tx.ChirpsByAuthor(authorID)
+		return nil
+	})
+	return chirps
+}
+
+func sortChirps(chirps []Chirp) {
+	sort.Slice(chirps, func(i, j int) bool { return chirps[i].ID < chirps[j].ID })
 }
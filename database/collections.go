@@ -0,0 +1,128 @@
+package database
+
+import (
+	"sort"
+	"sync"
+)
+
+// collections in lock order. Transactions lock the collections they
+// use in this order, so two transactions can never deadlock.
+var collections = []string{collectionUsers, collectionChirps, collectionSessions}
+
+// collections migrations have removed, whose files older generations
+// may still have
+var retiredCollections = []string{legacyCollectionTokens}
+
+// collectionLocks guard DB.data and the indexes per collection, so
+// that writers of one collection do not hold up readers of another
+type collectionLocks map[string]*collectionLock
+
+type collectionLock struct {
+	sync.RWMutex
+	// number of the last commit request applied to the collection in
+	// memory, which readers wait to be flushed. Written under the
+	// write lock.
+	applied uint64
+}
+
+func newCollectionLocks() collectionLocks {
+	locks := make(collectionLocks, len(collections))
+	for _, collection := range collections {
+		locks[collection] = &collectionLock{}
+	}
+	return locks
+}
+
+// lock the collections in scope in lock order and return the
+// function that unlocks them again
+func (l collectionLocks) lock(scope []string, write bool) func() {
+	ordered := lockOrder(scope)
+	for _, collection := range ordered {
+		if write {
+			l[collection].Lock()
+		} else {
+			l[collection].RLock()
+		}
+	}
+	return func() {
+		for i := len(ordered) - 1; i >= 0; i-- {
+			if write {
+				l[ordered[i]].Unlock()
+			} else {
+				l[ordered[i]].RUnlock()
+			}
+		}
+	}
+}
+
+// record that the commit request numbered n was applied to the
+// collections in scope, whose write locks the caller holds
+func (l collectionLocks) markApplied(scope []string, n uint64) {
+	for _, collection := range scope {
+		l[collection].applied = n
+	}
+}
+
+// number of the last commit request applied to any collection in
+// scope, whose locks the caller holds
+func (l collectionLocks) applied(scope []string) uint64 {
+	n := uint64(0)
+	for _, collection := range scope {
+		n = max(n, l[collection].applied)
+	}
+	return n
+}
+
+// scope deduplicated and sorted into lock order
+func lockOrder(scope []string) []string {
+	rank := make(map[string]int, len(collections))
+	for i, collection := range collections {
+		rank[collection] = i
+	}
+	seen := make(map[string]struct{}, len(scope))
+	ordered := make([]string, 0, len(scope))
+	for _, collection := range scope {
+		if _, ok := rank[collection]; !ok {
+			panic("database: unknown collection " + collection)
+		}
+		if _, ok := seen[collection]; ok {
+			continue
+		}
+		seen[collection] = struct{}{}
+		ordered = append(ordered, collection)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return rank[ordered[i]] < rank[ordered[j]] })
+	return ordered
+}
+
+// take every collection's write lock, for work that needs the whole
+// database to stand still: reloads, restores and Close
+func (db *DB) lockAll() func() {
+	return db.locks.lock(collections, true)
+}
+
+// take every collection's write lock if none is held, reporting
+// whether it did. The committer cannot wait for the locks: readers hold
+// them while they wait for it to flush.
+func (db *DB) tryLockAll() (func(), bool) {
+	for i, collection := range collections {
+		if !db.locks[collection].TryLock() {
+			for j := i - 1; j >= 0; j-- {
+				db.locks[collections[j]].Unlock()
+			}
+			return nil, false
+		}
+	}
+	return func() {
+		for i := len(collections) - 1; i >= 0; i-- {
+			db.locks[collections[i]].Unlock()
+		}
+	}, true
+}
+
+// last ID handed out in collection
+func (db *DB) sequence(collection string) int {
+	db.seqMux.Lock()
+	defer db.seqMux.Unlock()
+	return db.data.Sequences[collection]
+}
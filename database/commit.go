@@ -0,0 +1,344 @@
+package database
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+var ErrClosed = errors.New("database is closed")
+
+const (
+	defaultCommitWindow   = 2 * time.Millisecond
+	defaultCommitMaxBatch = 256
+)
+
+// commitRequest carries the log records of one committed transaction
+// to the committer goroutine, which reports the flush result on done
+type commitRequest struct {
+	// position in the queue, numbered from 1 by push
+	number  uint64
+	records []logRecord
+	// work that needs the log to itself, run by the committer instead
+	// of flushing records. Only pushed by quiesce holders, so it is
+	// always alone in its batch.
+	run  func() error
+	done chan error
+}
+
+// commitQueue hands transactions from Update to the committer in the
+// order they took their write locks. push never blocks, so it is safe to
+// call with collection locks held.
+type commitQueue struct {
+	mu      sync.Mutex
+	pending []*commitRequest
+	closed  bool
+	notify  chan struct{}
+	// change feed seq of the last record pushed
+	lastSeq int64
+	// whether the committer is working on a batch
+	inflight bool
+	// signalled when the committer finishes a batch
+	idle *sync.Cond
+	// number of the last request pushed and of the last one that made
+	// it to disk or was dropped
+	pushed, flushed uint64
+	// set from a failed flush until the unflushed requests are dropped
+	failed bool
+	// signalled when flushed or failed change
+	durable *sync.Cond
+}
+
+func newCommitQueue() *commitQueue {
+	q := &commitQueue{notify: make(chan struct{}, 1)}
+	q.idle = sync.NewCond(&q.mu)
+	q.durable = sync.NewCond(&q.mu)
+	return q
+}
+
+// queue req, numbering its puts and deletes for the change feed in
+// the order they will reach the log. Records that already have a seq,
+// copied from another database's feed, keep it.
+func (q *commitQueue) push(req *commitRequest) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+	q.pushed++
+	req.number = q.pushed
+	for i := range req.records {
+		switch {
+		case req.records[i].Seq != 0:
+			q.lastSeq = max(q.lastSeq, req.records[i].Seq)
+		case req.records[i].Op == opPut || req.records[i].Op == opDelete:
+			q.lastSeq++
+			req.records[i].Seq = q.lastSeq
+		}
+	}
+	q.pending = append(q.pending, req)
+	q.wake()
+	return nil
+}
+
+func (q *commitQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.wake()
+}
+
+func (q *commitQueue) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take every pending request after a failed flush. Memory no longer
+// holds anything that is waiting to reach the disk, so readers stop
+// waiting.
+func (q *commitQueue) drain() []*commitRequest {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	batch := q.pending
+	q.pending = nil
+	q.flushed = q.pushed
+	q.failed = false
+	q.durable.Broadcast()
+	return batch
+}
+
+// record that every request up to number n is on disk
+func (q *commitQueue) markFlushed(n uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.flushed = max(q.flushed, n)
+	q.durable.Broadcast()
+}
+
+// record that a flush failed, waking the readers waiting for it
+func (q *commitQueue) markFailed() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.failed = true
+	q.durable.Broadcast()
+}
+
+// wait until every request up to number n is on disk and report true,
+// or report false as soon as a flush fails
+func (q *commitQueue) waitFlushed(n uint64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.flushed < n && !q.failed {
+		q.durable.Wait()
+	}
+	return q.flushed >= n
+}
+
+// wait until the requests of a failed flush have been dropped
+func (q *commitQueue) waitRecovered() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.failed {
+		q.durable.Wait()
+	}
+}
+
+// continue numbering after seq, the last seq that is on disk
+func (q *commitQueue) resetSeq(seq int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.lastSeq = seq
+}
+
+func (q *commitQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// take up to maxBatch pending requests
+func (q *commitQueue) take(maxBatch int) []*commitRequest {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := min(len(q.pending), maxBatch)
+	batch := q.pending[:n:n]
+	q.pending = q.pending[n:]
+	q.inflight = n > 0
+	return batch
+}
+
+// mark the batch taken last as done
+func (q *commitQueue) finish() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.inflight = false
+	q.idle.Broadcast()
+}
+
+// wait until nothing is queued or being flushed
+func (q *commitQueue) waitIdle() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.pending) > 0 || q.inflight {
+		q.idle.Wait()
+	}
+}
+
+func (q *commitQueue) isIdle() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending) == 0 && !q.inflight
+}
+
+// next waits for the first pending request, then keeps collecting for
+// up to window or until maxBatch requests are queued. It returns false
+// once the queue is closed and drained.
+func (q *commitQueue) next(window time.Duration, maxBatch int) ([]*commitRequest, bool) {
+	for {
+		q.mu.Lock()
+		n, closed := len(q.pending), q.closed
+		q.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if closed {
+			return nil, false
+		}
+		<-q.notify
+	}
+	if window > 0 {
+		timer := time.NewTimer(window)
+		defer timer.Stop()
+	collect:
+		for q.len() < maxBatch {
+			select {
+			case <-q.notify:
+			case <-timer.C:
+				break collect
+			}
+		}
+	}
+	return q.take(maxBatch), true
+}
+
+// CommitStats describes the batches flushed by the group committer
+type CommitStats struct {
+	Batches      uint64
+	Transactions uint64
+	LargestBatch int
+	// BatchSizes[i] counts batches of 2^i to 2^(i+1)-1 transactions,
+	// the last bucket also holds everything larger
+	BatchSizes [8]uint64
+}
+
+func (s *CommitStats) record(batchSize int) {
+	s.Batches++
+	s.Transactions += uint64(batchSize)
+	s.LargestBatch = max(s.LargestBatch, batchSize)
+	bucket := 0
+	for size := batchSize; size > 1 && bucket < len(s.BatchSizes)-1; size /= 2 {
+		bucket++
+	}
+	s.BatchSizes[bucket]++
+}
+
+// CommitStats returns a snapshot of the group commit metrics
+func (db *DB) CommitStats() CommitStats {
+	db.statsMux.Lock()
+	defer db.statsMux.Unlock()
+	return db.stats
+}
+
+// runCommitter flushes queued transactions to the log, one write and
+// fsync per batch, and acknowledges each caller afterwards
+func (db *DB) runCommitter() {
+	defer close(db.committerDone)
+	for {
+		batch, ok := db.commits.next(db.commitWindow, db.commitMaxBatch)
+		if !ok {
+			return
+		}
+		if batch[0].run != nil {
+			batch[0].done <- batch[0].run()
+			db.commits.markFlushed(batch[0].number)
+			db.commits.finish()
+			continue
+		}
+		records := []logRecord{}
+		for _, req := range batch {
+			records = append(records, req.records...)
+		}
+		err := db.appendLog(records...)
+		if err != nil {
+			db.commits.markFailed()
+		}
+		if errors.Is(err, ErrModifiedExternally) {
+			batch = append(batch, db.stopWrites(err)...)
+		} else if err != nil {
+			// the batch is already in memory and later transactions
+			// may build on it, so everything queued behind it fails
+			// too and memory is reloaded from disk
+			batch = append(batch, db.rollbackUnflushed()...)
+		} else {
+			db.statsMux.Lock()
+			db.stats.record(len(batch))
+			db.statsMux.Unlock()
+			for _, req := range batch {
+				db.feed.publish(changesFromRecords(req.records))
+			}
+			db.commits.markFlushed(batch[len(batch)-1].number)
+		}
+		for _, req := range batch {
+			req.done <- err
+		}
+		db.commits.finish()
+		if err == nil {
+			db.maybeCompact()
+		}
+	}
+}
+
+// take every collection's write lock once the committer has flushed
+// everything queued, so that nothing else touches the data or the log
+func (db *DB) quiesce() func() {
+	for {
+		unlock := db.lockAll()
+		if db.commits.isIdle() {
+			return unlock
+		}
+		unlock()
+		db.commits.waitIdle()
+	}
+}
+
+// drop every queued transaction and reload DB.data from disk,
+// returning the dropped requests
+func (db *DB) rollbackUnflushed() []*commitRequest {
+	unlock := db.lockAll()
+	defer unlock()
+	dropped := db.commits.drain()
+	if _, err := db.loadDB(); err != nil {
+		// memory still holds the dropped changes, writing on top of
+		// them would make them durable after all
+		log.Printf("database: cannot reload after failed flush: %v, refusing further writes until restart", err)
+		db.writeErr = err
+	}
+	// the dropped changes were never published, so their seqs are
+	// handed out again
+	db.commits.resetSeq(db.data.ChangeSeq)
+	return dropped
+}
+
+// refuse all further writes after another process changed the files
+// under us, returning the queued requests. Memory is not reloaded: the
+// files on disk are no longer ours to interpret, a restart is needed.
+func (db *DB) stopWrites(err error) []*commitRequest {
+	unlock := db.lockAll()
+	defer unlock()
+	log.Printf("database: %v, refusing further writes until restart", err)
+	db.writeErr = err
+	return db.commits.drain()
+}
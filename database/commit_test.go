@@ -0,0 +1,138 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// open a database in the directory /data of fsys
+func openTestDB(t *testing.T, fsys FS, opts Options) *DB {
+	t.Helper()
+	if err := fsys.MkdirAll("/data", 0700); err != nil {
+		t.Fatal(err)
+	}
+	opts.FS = fsys
+	db, err := NewDBWithOptions("/data/database.json", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// fail the next fsync of the log, holding it until release is closed
+// and closing reached once it has started
+func stallLogSync(fsys *FaultFS) (reached, release chan struct{}) {
+	reached = make(chan struct{})
+	release = make(chan struct{})
+	var once sync.Once
+	fsys.SetInjector(func(op Op) *Fault {
+		if op.Kind != OpSync || !strings.HasSuffix(op.Name, ".log") {
+			return nil
+		}
+		var fault *Fault
+		once.Do(func() {
+			close(reached)
+			<-release
+			fault = &Fault{}
+		})
+		return fault
+	})
+	return reached, release
+}
+
+func TestReadersDoNotSeeUnflushedWrites(t *testing.T) {
+	fsys := NewFaultFS(NewMemFS())
+	db := openTestDB(t, fsys, Options{})
+	kept, err := db.CreateChirp("kept", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := db.ChangeSeq()
+
+	reached, release := stallLogSync(fsys)
+	lost := make(chan error, 1)
+	go func() {
+		_, err := db.CreateChirp("lost", 1)
+		lost <- err
+	}()
+	<-reached
+
+	// read everything while the write is in memory but not on disk
+	type read struct {
+		chirps []Chirp
+		backup bytes.Buffer
+		seq    int64
+		err    error
+	}
+	reads := make(chan *read, 1)
+	go func() {
+		r := &read{}
+		r.chirps = db.GetChirps()
+		r.err = db.Backup(&r.backup)
+		r.seq = db.ChangeSeq()
+		reads <- r
+	}()
+	select {
+	case <-reads:
+		t.Fatal("read returned while the write was being flushed")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+
+	if err := <-lost; !errors.Is(err, ErrInjected) {
+		t.Fatalf("CreateChirp = %v, want the injected fault", err)
+	}
+	r := <-reads
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if len(r.chirps) != 1 || r.chirps[0].ID != kept.ID {
+		t.Errorf("GetChirps = %+v, want only chirp %d", r.chirps, kept.ID)
+	}
+	if strings.Contains(r.backup.String(), "lost") {
+		t.Error("backup holds the chirp whose flush failed")
+	}
+	if r.seq != seq {
+		t.Errorf("ChangeSeq = %d, want %d", r.seq, seq)
+	}
+
+	// the dropped change's seq is handed out again
+	fsys.SetInjector(nil)
+	if _, err := db.CreateChirp("next", 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := db.ChangeSeq(); got != seq+1 {
+		t.Errorf("ChangeSeq = %d, want %d", got, seq+1)
+	}
+}
+
+func TestFailedReloadStopsWrites(t *testing.T) {
+	fsys := NewFaultFS(NewMemFS())
+	db := openTestDB(t, fsys, Options{})
+	if _, err := db.CreateChirp("kept", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// the flush fails and so does reading the files back
+	fsys.SetInjector(func(op Op) *Fault {
+		if (op.Kind == OpSync && strings.HasSuffix(op.Name, ".log")) || op.Kind == OpReadFile {
+			return &Fault{}
+		}
+		return nil
+	})
+	if _, err := db.CreateChirp("lost", 1); !errors.Is(err, ErrInjected) {
+		t.Fatalf("CreateChirp = %v, want the injected fault", err)
+	}
+	fsys.SetInjector(nil)
+
+	// memory still holds the lost chirp, so nothing may be written on
+	// top of it
+	if _, err := db.CreateChirp("next", 1); !errors.Is(err, ErrInjected) {
+		t.Fatalf("CreateChirp after failed reload = %v, want the reload error", err)
+	}
+}
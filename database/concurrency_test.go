@@ -0,0 +1,232 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	hammerWorkers    = 8
+	hammerIterations = 30
+)
+
+func TestMain(m *testing.M) {
+	passwordCost = bcrypt.MinCost
+	os.Exit(m.Run())
+}
+
+// run every Store method from hammerWorkers goroutines at once. Each
+// worker owns a user, but reads everybody's chirps and sessions.
+func hammer(t *testing.T, s Store) {
+	t.Helper()
+	var wg sync.WaitGroup
+	for w := 0; w < hammerWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			hammerWorker(t, s, w)
+		}(w)
+	}
+	wg.Wait()
+}
+
+func hammerWorker(t *testing.T, s Store, w int) {
+	email := fmt.Sprintf("user%d@example.com", w)
+	user, err := s.CreateUser(email, "password")
+	if err != nil {
+		t.Errorf("worker %d: CreateUser: %v", w, err)
+		return
+	}
+	expires := time.Now().Add(time.Hour)
+	for i := 0; i < hammerIterations; i++ {
+		chirp, err := s.CreateChirp(fmt.Sprintf("chirp %d of worker %d", i, w), user.ID)
+		if err != nil {
+			t.Errorf("worker %d: CreateChirp: %v", w, err)
+			return
+		}
+		if got, err := s.GetChirpByChirpId(chirp.ID); err != nil || got.Body != chirp.Body {
+			t.Errorf("worker %d: GetChirpByChirpId(%d) = %+v, %v", w, chirp.ID, got, err)
+		}
+		s.GetChirps()
+		for _, got := range s.GetChirpsByAuthor(user.ID) {
+			if got.AuthorID != user.ID {
+				t.Errorf("worker %d: GetChirpsByAuthor returned chirp %d of %d", w, got.ID, got.AuthorID)
+			}
+		}
+
+		token := fmt.Sprintf("token-%d-%d", w, i)
+		session, err := s.CreateSession(user.ID, token, expires, SessionClient{UserAgent: "hammer"})
+		if err != nil {
+			t.Errorf("worker %d: CreateSession: %v", w, err)
+			return
+		}
+		if _, err := s.RotateRefreshToken(token, token+"-rotated", expires); err != nil {
+			t.Errorf("worker %d: RotateRefreshToken: %v", w, err)
+		}
+		s.GetSessions(user.ID)
+		if err := s.IsChirpyRed(user.ID); err != nil {
+			t.Errorf("worker %d: IsChirpyRed: %v", w, err)
+		}
+
+		switch i % 4 {
+		case 0:
+			if err := s.DeleteChirp(user.ID, chirp.ID); err != nil {
+				t.Errorf("worker %d: DeleteChirp(%d): %v", w, chirp.ID, err)
+			}
+			if err := s.RevokeRefreshToken(token + "-rotated"); err != nil {
+				t.Errorf("worker %d: RevokeRefreshToken: %v", w, err)
+			}
+		case 1:
+			err := s.RevokeSession(user.ID, session.ID)
+			if err != nil {
+				t.Errorf("worker %d: RevokeSession(%d): %v", w, session.ID, err)
+			}
+		case 2:
+			if _, err := s.RevokeAllRefreshTokens(token + "-rotated"); err != nil {
+				t.Errorf("worker %d: RevokeAllRefreshTokens: %v", w, err)
+			}
+		}
+	}
+
+	updated, err := s.UpdateUser(user.ID, "renamed-"+email, "new password")
+	if err != nil {
+		t.Errorf("worker %d: UpdateUser: %v", w, err)
+		return
+	}
+	if got, ok := s.IdentifyUser(updated.Email, "new password"); !ok || got.ID != user.ID {
+		t.Errorf("worker %d: IdentifyUser = %+v, %v", w, got, ok)
+	}
+}
+
+func TestConcurrentMemStore(t *testing.T) {
+	s := NewMemStore()
+	hammer(t, s)
+	checkHammered(t, s)
+}
+
+func TestConcurrentDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDBWithOptions(path, Options{
+		// purge tombstones and sessions while the workers use them
+		Retention:         RetentionPolicy{ChirpTombstones: time.Nanosecond, IdleSessions: time.Hour},
+		RetentionInterval: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// maintenance runs next to the workers until they are done
+	stop := make(chan struct{})
+	var maintenance sync.WaitGroup
+	for _, run := range []func() error{
+		func() error {
+			problems, err := db.Check()
+			if err == nil && len(problems) > 0 {
+				err = fmt.Errorf("problems %v", problems)
+			}
+			return err
+		},
+		func() error { return db.Export(io.Discard) },
+		func() error { return db.Backup(io.Discard) },
+		func() error {
+			_, err := db.ApplyRetention(time.Now())
+			return err
+		},
+		func() error { return followChanges(db) },
+	} {
+		maintenance.Add(1)
+		go func(run func() error) {
+			defer maintenance.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := run(); err != nil {
+					t.Errorf("maintenance: %v", err)
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}(run)
+	}
+	hammer(t, db)
+	close(stop)
+	maintenance.Wait()
+
+	checkHammered(t, db)
+	problems, err := db.Check()
+	if err != nil || len(problems) > 0 {
+		t.Fatalf("Check = %v, %v", problems, err)
+	}
+
+	// whatever the workers were told is stored has to survive a reopen
+	chirps := db.GetChirps()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if got := reopened.GetChirps(); !reflect.DeepEqual(got, chirps) {
+		t.Errorf("reopened database has %d chirps, want %d", len(got), len(chirps))
+	}
+}
+
+// read the change feed from the start, checking it has no gaps
+func followChanges(db *DB) error {
+	since := int64(0)
+	for {
+		page, err := db.Changes(since, 0)
+		if errors.Is(err, ErrChangesExpired) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, change := range page.Changes {
+			if change.Seq != since+1 {
+				return fmt.Errorf("change %d follows %d", change.Seq, since)
+			}
+			since = change.Seq
+		}
+		if len(page.Changes) == 0 {
+			return nil
+		}
+	}
+}
+
+// every worker leaves its user upgraded and renamed, with a chirp for
+// every iteration that did not delete one
+func checkHammered(t *testing.T, s Store) {
+	t.Helper()
+	live := 0
+	for _, chirp := range s.GetChirps() {
+		if !chirp.IsDeleted() {
+			live++
+		}
+	}
+	if want := hammerWorkers * (hammerIterations - (hammerIterations+3)/4); live != want {
+		t.Errorf("%d chirps left, want %d", live, want)
+	}
+	for w := 0; w < hammerWorkers; w++ {
+		email := fmt.Sprintf("renamed-user%d@example.com", w)
+		user, ok := s.IdentifyUser(email, "new password")
+		if !ok || !user.IsChirpyRed {
+			t.Errorf("user %s = %+v, %v", email, user, ok)
+		}
+	}
+}
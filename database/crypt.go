@@ -0,0 +1,136 @@
+package database
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var ErrNoKey = errors.New("database file is encrypted with a key that is not configured")
+
+var ErrNotEncrypted = errors.New("database file is not encrypted although a key is configured")
+
+const encryptionAESGCM = "aes-256-gcm"
+
+// additional data binding ciphertexts to where they are stored, so a
+// sealed log record cannot be passed off as a snapshot or vice versa
+var (
+	purposeSnapshot = []byte("chirpy snapshot")
+	purposeLog      = []byte("chirpy log")
+)
+
+// sealed is the on-disk envelope of encrypted snapshots and log records
+type sealed struct {
+	Encryption string `json:"encryption"`
+	KeyID      string `json:"key_id"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// keyring holds the AES-256-GCM keys for encryption at rest. New data
+// is sealed with the current key; the old keys are only used to open
+// data written before a key rotation.
+type keyring struct {
+	currentID string
+	keys      map[string]cipher.AEAD
+	// open returns plaintext input as is even with a current key,
+	// see Options.EncryptPlaintext
+	acceptPlaintext bool
+}
+
+func newKeyring(current []byte, old [][]byte) (*keyring, error) {
+	k := &keyring{keys: make(map[string]cipher.AEAD)}
+	if current == nil {
+		if len(old) > 0 {
+			return nil, errors.New("old encryption keys given without a current key")
+		}
+		return k, nil
+	}
+	for _, key := range append([][]byte{current}, old...) {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("encryption keys must be 32 bytes, got %d", len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[keyID(key)] = aead
+	}
+	k.currentID = keyID(current)
+	return k, nil
+}
+
+// the keyring of the keys in opts
+func optionsKeyring(opts Options) (*keyring, error) {
+	keys, err := newKeyring(opts.EncryptionKey, opts.OldEncryptionKeys)
+	if err != nil {
+		return nil, err
+	}
+	keys.acceptPlaintext = opts.EncryptPlaintext
+	return keys, nil
+}
+
+// short fingerprint naming a key in sealed envelopes
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+func (k *keyring) enabled() bool {
+	return k.currentID != ""
+}
+
+// seal plaintext with the current key, or return it unchanged
+// when encryption is disabled
+func (k *keyring) seal(plaintext, purpose []byte) ([]byte, error) {
+	if !k.enabled() {
+		return plaintext, nil
+	}
+	aead := k.keys[k.currentID]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealed{
+		Encryption: encryptionAESGCM,
+		KeyID:      k.currentID,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plaintext, purpose),
+	})
+}
+
+// open raw if it is a sealed envelope and return the plaintext along
+// with the ID of the key that opened it, "" for plaintext input. Once
+// there is a current key, plaintext input fails with ErrNotEncrypted
+// unless acceptPlaintext is set, so nobody can swap in files of their
+// own by writing them unencrypted.
+func (k *keyring) open(raw, purpose []byte) ([]byte, string, error) {
+	envelope := sealed{}
+	if err := json.Unmarshal(raw, &envelope); err != nil || envelope.Ciphertext == nil {
+		if k.enabled() && !k.acceptPlaintext {
+			return nil, "", ErrNotEncrypted
+		}
+		return raw, "", nil
+	}
+	if envelope.Encryption != encryptionAESGCM {
+		return nil, "", fmt.Errorf("unknown encryption %q", envelope.Encryption)
+	}
+	aead, ok := k.keys[envelope.KeyID]
+	if !ok {
+		return nil, "", fmt.Errorf("%w (key id %s)", ErrNoKey, envelope.KeyID)
+	}
+	plaintext, err := aead.Open(nil, envelope.Nonce, envelope.Ciphertext, purpose)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot decrypt with key %s: %w", envelope.KeyID, err)
+	}
+	return plaintext, envelope.KeyID, nil
+}
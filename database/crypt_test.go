@@ -0,0 +1,60 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestEncryptedDatabaseRejectsPlaintext(t *testing.T) {
+	fsys := NewMemFS()
+	db := openTestDB(t, fsys, Options{})
+	if _, err := db.CreateUser("user@example.com", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	key := bytes.Repeat([]byte{1}, 32)
+	open := func(opts Options) (*DB, error) {
+		opts.FS = fsys
+		opts.EncryptionKey = key
+		return NewDBWithOptions("/data/database.json", opts)
+	}
+
+	// turning encryption on takes the explicit migration
+	if _, err := open(Options{}); !errors.Is(err, ErrNotEncrypted) {
+		t.Fatalf("open plaintext database with a key = %v, want ErrNotEncrypted", err)
+	}
+	db, err := open(Options{EncryptPlaintext: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = open(Options{})
+	if err != nil {
+		t.Fatalf("open encrypted database = %v", err)
+	}
+	if _, ok := db.IdentifyUser("user@example.com", "password"); !ok {
+		t.Error("user lost in the migration")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// and plaintext written next to the encrypted files is refused
+	f, err := fsys.OpenFile(logPath("/data/database.json"), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(`{"op":"put","collection":"users","id":2,"value":{"id":2,"email":"intruder@example.com"}}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := open(Options{}); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("open with a plaintext log record = %v, want ErrNotEncrypted", err)
+	}
+}
@@ -1,24 +1,66 @@
 package database
 
 import (
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"sync"
+	"time"
 )
 
 type Chirp struct {
-	ID       int    `json:"id"`
-	Body     string `json:"body"`
-	AuthorID int    `json:"author_id"`
+	ID        int        `json:"id"`
+	Body      string     `json:"body"`
+	AuthorID  int        `json:"author_id"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// ID the chirp had in the export a merge import gave it a new
+	// ID from, see importedBefore
+	ImportedID int `json:"imported_id,omitempty"`
+}
+
+// IsDeleted reports whether the chirp is a tombstone
+func (c Chirp) IsDeleted() bool {
+	return c.DeletedAt != nil
 }
 
 type User struct {
-	ID           int    `json:"id"`
-	Email        string `json:"email"`
-	Password     []byte `json:"password"`
-	RefreshToken string `json:"refresh_token"`
-	IsChirpyRed  bool   `json:"is_chirpy_red"`
+	ID          int    `json:"id"`
+	Email       string `json:"email"`
+	Password    []byte `json:"password"`
+	IsChirpyRed bool   `json:"is_chirpy_red"`
+}
+
+// Session is one login of a user, on one device. It is used with a
+// refresh token of which only the hash is stored. Every refresh
+// replaces the token, the session is the family of all its tokens.
+type Session struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"user_id"`
+	TokenHash  string    `json:"token_hash"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	// when the current refresh token stops working
+	ExpiresAt time.Time `json:"expires_at"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	// hashes of the tokens refreshes replaced, newest last, at most
+	// maxRotatedTokens
+	RotatedTokenHashes []string `json:"rotated_token_hashes,omitempty"`
+}
+
+// Expired reports whether the session's refresh token has expired at now
+func (s Session) Expired(now time.Time) bool {
+	return !now.Before(s.ExpiresAt)
+}
+
+// HashRefreshToken returns the hash a session stores of its refresh
+// token, hex encoded SHA-256
+func HashRefreshToken(refreshToken string) string {
+	sum := sha256.Sum256([]byte(refreshToken))
+	return hex.EncodeToString(sum[:])
 }
 
 type UserWithoutPW struct {
@@ -27,65 +69,402 @@ type UserWithoutPW struct {
 	IsChirpyRed bool   `json:"is_chirpy_red"`
 }
 
+// DB is the file-backed Store. Every collection has its own lock that
+// guards its part of data and index, so transactions on different
+// collections run side by side. Readers share the read locks of the
+// collections they use, writers hold them exclusively, and work on
+// the log and the files holds all of them. seqMux guards the
+// sequences, which transactions on any collection may read.
+// No method touches data outside a transaction.
 type DB struct {
-	path string
-	mux  *sync.RWMutex
-	Data *DbData `json:"data"`
+	path       string
+	fsys       FS
+	format     SnapshotFormat
+	lock       File
+	keys       *keyring
+	backups    int
+	locks      collectionLocks
+	seqMux     sync.Mutex
+	log        File
+	logSize    int64
+	logRecords int
+	index      *indexes
+	data       *DbData
+	// generation of the collection files the manifest refers to
+	generation int
+	// state of the manifest when we last read or wrote it
+	snapshotInfo os.FileInfo
+	// set once writing is no longer safe, every Update fails with it
+	writeErr error
+
+	commits        *commitQueue
+	commitWindow   time.Duration
+	commitMaxBatch int
+	committerDone  chan struct{}
+	statsMux       sync.Mutex
+	stats          CommitStats
+
+	// nil when scheduled backups are disabled
+	schedule  *backupSchedule
+	retention RetentionPolicy
+	// nil when scheduled retention is disabled
+	retentionSchedule *retentionSchedule
+	feed              *changeFeed
 }
 
 type DbData struct {
-	Chirps map[int]Chirp `json:"chirps"`
-	Users  map[int]User  `json:"users"`
+	Chirps   map[int]Chirp   `json:"chirps"`
+	Users    map[int]User    `json:"users"`
+	Sessions map[int]Session `json:"sessions"`
+	// last ID handed out per collection, IDs are never reused
+	Sequences map[string]int `json:"sequences"`
+	// seq of the last change committed, see Changes
+	ChangeSeq int64 `json:"change_seq"`
+}
+
+func newDbData() *DbData {
+	return &DbData{
+		Chirps:    make(map[int]Chirp),
+		Users:     make(map[int]User),
+		Sessions:  make(map[int]Session),
+		Sequences: make(map[string]int),
+	}
+}
+
+// pointer to the map holding collection, nil for unknown collections
+func (data *DbData) collection(name string) any {
+	switch name {
+	case collectionUsers:
+		return &data.Users
+	case collectionChirps:
+		return &data.Chirps
+	case collectionSessions:
+		return &data.Sessions
+	}
+	return nil
+}
+
+// replace the nil maps of collections stored as null with empty ones
+func (data *DbData) fillMaps() {
+	if data.Chirps == nil {
+		data.Chirps = make(map[int]Chirp)
+	}
+	if data.Users == nil {
+		data.Users = make(map[int]User)
+	}
+	if data.Sessions == nil {
+		data.Sessions = make(map[int]Session)
+	}
+	if data.Sequences == nil {
+		data.Sequences = make(map[string]int)
+	}
 }
 
-// NewDB creates a new database connection
-// and creates the database file if it doesn't exist
+// Options configures a DB opened with NewDBWithOptions
+type Options struct {
+	// number of rotated backup generations kept next to the
+	// database file, defaults to defaultBackups
+	Backups int
+	// how long the committer keeps collecting transactions before
+	// flushing them together, defaults to defaultCommitWindow.
+	// Negative flushes as soon as a transaction arrives.
+	CommitWindow time.Duration
+	// most transactions flushed in one batch,
+	// defaults to defaultCommitMaxBatch
+	CommitMaxBatch int
+	// 32 byte AES-256-GCM key the database files are encrypted with,
+	// nil leaves them in plaintext
+	EncryptionKey []byte
+	// keys the files may still be encrypted with after a rotation;
+	// NewDB re-encrypts them with EncryptionKey
+	OldEncryptionKeys [][]byte
+	// let NewDB read files that are not encrypted although
+	// EncryptionKey is set, and encrypt them. Meant for the first
+	// start after turning encryption on: without it such files fail
+	// with ErrNotEncrypted, and after the open they fail either way.
+	EncryptPlaintext bool
+	// filesystem the database files live on, defaults to OSFS
+	FS FS
+	// encoding of the database file, defaults to FormatJSON. Files in
+	// the other format are read and converted on open.
+	Format SnapshotFormat
+	// directory for scheduled backups, "" disables them
+	BackupDir string
+	// time between scheduled backups, defaults to defaultBackupInterval
+	BackupInterval time.Duration
+	// number of recent hours and days of which the newest scheduled
+	// backup is kept, defaulting to defaultBackupKeepHourly and
+	// defaultBackupKeepDaily. Negative keeps none.
+	BackupKeepHourly int
+	BackupKeepDaily  int
+	// how long committed changes stay in the change feed, defaults to
+	// defaultChangeRetention
+	ChangeRetention time.Duration
+	// most changes kept in the change feed, defaults to
+	// defaultChangeRetentionMax
+	ChangeRetentionMax int
+	// how long data nobody reads any more is kept, see ApplyRetention
+	Retention RetentionPolicy
+	// time between scheduled retention runs, defaults to
+	// defaultRetentionInterval. Negative disables them, leaving
+	// ApplyRetention to the caller.
+	RetentionInterval time.Duration
+}
+
+const defaultBackups = 3
+
+// NewDB creates a new database connection with default options
 func NewDB(path string) (*DB, error) {
-	chirpsMap := make(map[int]Chirp)
-	usersMap := make(map[int]User)
+	return NewDBWithOptions(path, Options{})
+}
+
+// NewDBWithOptions creates a new database connection
+// and creates the database file if it doesn't exist.
+// Mutations are appended to a write-ahead log next to the
+// database file, which is replayed here on startup.
+// The database is locked against other processes until Close
+func NewDBWithOptions(path string, opts Options) (*DB, error) {
+	if opts.Backups == 0 {
+		opts.Backups = defaultBackups
+	}
+	if opts.CommitWindow == 0 {
+		opts.CommitWindow = defaultCommitWindow
+	}
+	if opts.CommitMaxBatch <= 0 {
+		opts.CommitMaxBatch = defaultCommitMaxBatch
+	}
+	if opts.FS == nil {
+		opts.FS = OSFS{}
+	}
+	if opts.Retention.ChirpTombstones == 0 {
+		opts.Retention.ChirpTombstones = defaultChirpTombstoneAge
+	}
+	format, err := ParseSnapshotFormat(string(opts.Format))
+	if err != nil {
+		return nil, err
+	}
+	keys, err := optionsKeyring(opts)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := acquireLock(opts.FS, path)
+	if err != nil {
+		return nil, err
+	}
 	db := &DB{
-		path: path,
-		mux:  &sync.RWMutex{},
-		Data: &DbData{
-			Chirps: chirpsMap,
-			Users:  usersMap,
-		},
-	}
-	if _, err := os.Stat(path); os.IsNotExist(err) {
+		path:              path,
+		fsys:              opts.FS,
+		format:            format,
+		lock:              lock,
+		keys:              keys,
+		backups:           opts.Backups,
+		locks:             newCollectionLocks(),
+		data:              newDbData(),
+		commits:           newCommitQueue(),
+		commitWindow:      opts.CommitWindow,
+		commitMaxBatch:    opts.CommitMaxBatch,
+		committerDone:     make(chan struct{}),
+		schedule:          newBackupSchedule(opts),
+		retention:         opts.Retention,
+		retentionSchedule: newRetentionSchedule(opts),
+		feed:              newChangeFeed(opts),
+	}
+	err = db.open()
+	if err != nil {
+		if db.log != nil {
+			db.log.Close()
+		}
+		lock.Close()
+		return nil, err
+	}
+	db.commits.resetSeq(db.data.ChangeSeq)
+	go db.runCommitter()
+	if db.schedule != nil {
+		go db.runBackups()
+	}
+	if db.retentionSchedule != nil {
+		go db.runRetention()
+	}
+	return db, nil
+}
+
+// load the database from disk, creating it if necessary
+func (db *DB) open() error {
+	if _, err := db.fsys.Stat(db.path); errors.Is(err, os.ErrNotExist) {
 		err := db.writeDBtoDisk()
 		if err != nil {
-			return nil, fmt.Errorf("cannot create DB file: %w", err)
+			return fmt.Errorf("cannot create DB file: %w", err)
 		}
 	}
-	err := db.loadDB()
+	state, err := db.loadDB()
 	if err != nil {
-		return nil, fmt.Errorf("cannot load DB: %w", err)
+		return fmt.Errorf("cannot load DB: %w", err)
 	}
-	return db, nil
+	err = tightenPermissions(db.fsys, db.path, db.backups)
+	if err != nil {
+		return err
+	}
+	err = db.openLog()
+	if err != nil {
+		return fmt.Errorf("cannot open DB log: %w", err)
+	}
+	// the log must always match the snapshot's schema version,
+	// so migrated data is folded into a new snapshot right away
+	if state.migrated || state.reencrypt || state.reformat || state.split {
+		err = db.compact()
+		if err != nil {
+			return fmt.Errorf("cannot rewrite DB: %w", err)
+		}
+	}
+	// backups are still readable with the previous key or none
+	if state.reencrypt {
+		err = removeBackups(db.fsys, db.path, db.backups)
+		if err != nil {
+			return err
+		}
+		err = removeGenerations(db.fsys, db.path, db.generation)
+		if err != nil {
+			return err
+		}
+	}
+	// the files are encrypted now, plaintext is not accepted again
+	db.keys.acceptPlaintext = false
+	return nil
 }
 
-// write DB.data to Disk
-func (db *DB) writeDBtoDisk() error {
-	jsonData, err1 := json.MarshalIndent(db.Data, "", " ")
-	if err1 != nil {
-		return err1
+// restrict the database files to the owner, they used to be
+// created world readable
+func tightenPermissions(fsys FS, path string, backups int) error {
+	paths := []string{path, logPath(path), lockPath(path), changesPath(path)}
+	for generation := 1; generation <= backups; generation++ {
+		paths = append(paths, backupPath(path, generation))
 	}
-	err2 := os.WriteFile(db.path, []byte(jsonData), 0644)
-	if err2 != nil {
-		return err2
+	for _, p := range paths {
+		err := fsys.Chmod(p, 0600)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
 	}
 	return nil
 }
 
-// load DB.data to memory
-func (db *DB) loadDB() error {
-	data, err1 := os.ReadFile(db.path)
-	if err1 != nil {
-		return err1
+// write a full snapshot of DB.data to disk
+func (db *DB) writeDBtoDisk() error {
+	if err := db.checkUnmodified(); err != nil {
+		return err
 	}
-	err2 := json.Unmarshal(data, db.Data)
-	if err2 != nil {
-		return err2
+	generation, err := writeCollections(db.fsys, db.path, db.data, db.generation, db.format, db.keys, db.backups)
+	if err != nil {
+		return err
 	}
+	db.generation = generation
+	db.recordSnapshotState()
 	return nil
 }
+
+// what loadDB found that requires rewriting the snapshot
+type loadState struct {
+	// migrations ran
+	migrated bool
+	// the snapshot is not encrypted with the current key
+	reencrypt bool
+	// the snapshot is not in the configured format
+	reformat bool
+	// the snapshot is a single file, not a manifest and collection files
+	split bool
+}
+
+// load DB.data to memory: read the snapshot, replay the log on top of
+// it and migrate the result to the current schema version
+func (db *DB) loadDB() (loadState, error) {
+	stored, err := readStoredWithFallback(db.fsys, db.path, db.backups, db.keys)
+	if err != nil {
+		return loadState{}, err
+	}
+	replayed := []logRecord{}
+	data, records, applied, err := loadSnapshot(stored, func(apply func(logRecord) error) (int, error) {
+		return replayLog(db.fsys, logPath(db.path), func(record logRecord) error {
+			replayed = append(replayed, record)
+			return apply(record)
+		}, db.keys, true)
+	})
+	if err != nil {
+		return loadState{}, err
+	}
+	// the feed starts with the changes the last compaction kept,
+	// followed by those still in the log
+	if stored, ok := readRetainedChanges(db.fsys, db.path, db.keys); ok {
+		db.feed.restore(stored, data.ChangeSeq)
+	}
+	changes := changesFromRecords(replayed)
+	floor := data.ChangeSeq
+	if len(changes) > 0 {
+		floor = changes[0].Seq - 1
+	}
+	db.feed.load(floor, changes)
+	for _, m := range applied {
+		log.Printf("database: applied migration %d: %s", m.Version, m.Description)
+	}
+	db.data = data
+	db.index = buildIndexes(data)
+	db.logRecords = records
+	db.generation = stored.generation
+	if stored.collections == nil {
+		db.generation, err = latestGeneration(db.fsys, db.path)
+		if err != nil {
+			return loadState{}, err
+		}
+	}
+	db.recordSnapshotState()
+	state := loadState{
+		migrated: len(applied) > 0,
+		split:    stored.collections == nil,
+	}
+	state.reencrypt, state.reformat = stored.differs(db.keys.currentID, db.format)
+	if state.reencrypt {
+		log.Printf("database: re-encrypting %s with key %s", db.path, db.keys.currentID)
+	}
+	if state.reformat {
+		log.Printf("database: converting %s to %s", db.path, db.format)
+	}
+	if state.split {
+		log.Printf("database: splitting %s into collection files", db.path)
+	}
+	return state, nil
+}
+
+// replay the log on top of the snapshot and migrate the result,
+// returning the data, the number of log records and the migrations
+// that ran. replay feeds the log records to apply. Snapshots at the
+// current schema version are decoded straight into DbData, older ones
+// go through a document.
+func loadSnapshot(stored storedDB, replay func(apply func(logRecord) error) (int, error)) (*DbData, int, []Migration, error) {
+	if stored.manifest.Version == currentVersion() {
+		data, err := stored.decodeData()
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		records, err := replay(data.apply)
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("cannot replay log: %w", err)
+		}
+		return data, records, nil, nil
+	}
+	doc, err := stored.document()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	records, err := replay(doc.apply)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("cannot replay log: %w", err)
+	}
+	applied, err := migrate(doc, stored.manifest.Version)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	data, err := documentToData(doc)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return data, records, applied, nil
+}
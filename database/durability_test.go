@@ -0,0 +1,206 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const durabilityPath = "/data/database.json"
+
+// what a durability scenario was told is stored, and what it was told
+// failed
+type acknowledged struct {
+	userCreated, userFailed bool
+	red, redFailed          bool
+	// chirp bodies
+	chirps       map[string]Chirp
+	failedChirps []string
+	// chirp IDs
+	deleted       map[int]bool
+	failedDeletes []int
+}
+
+// open the database, write to it and close it, twice: first creating
+// it, then reopening it. Every call that fails is recorded as not
+// acknowledged; a database that fails to open is not written to, and
+// neither is one that fails to create the user.
+func durabilityScenario(fsys FS) *acknowledged {
+	ack := &acknowledged{chirps: map[string]Chirp{}, deleted: map[int]bool{}}
+	userID := 0
+	for session := 1; session <= 2; session++ {
+		db, err := NewDBWithOptions(durabilityPath, Options{FS: fsys, RetentionInterval: -1})
+		if err != nil {
+			continue
+		}
+		// chirps need an author
+		if !ack.userCreated {
+			user, err := db.CreateUser("user@example.com", "password")
+			ack.userCreated, ack.userFailed = err == nil, err != nil
+			if err != nil {
+				db.Close()
+				continue
+			}
+			userID = user.ID
+		}
+		for i := 1; i <= 2; i++ {
+			body := fmt.Sprintf("chirp %d of session %d", i, session)
+			if chirp, err := db.CreateChirp(body, userID); err == nil {
+				ack.chirps[body] = chirp
+			} else {
+				ack.failedChirps = append(ack.failedChirps, body)
+			}
+		}
+		if session == 1 {
+			if err := db.IsChirpyRed(userID); err == nil {
+				ack.red = true
+			} else {
+				ack.redFailed = true
+			}
+		} else if chirp, ok := ack.chirps["chirp 1 of session 1"]; ok {
+			if err := db.DeleteChirp(userID, chirp.ID); err == nil {
+				ack.deleted[chirp.ID] = true
+			} else {
+				ack.failedDeletes = append(ack.failedDeletes, chirp.ID)
+			}
+		}
+		db.Close()
+	}
+	return ack
+}
+
+// reopen the database without faults and compare it with ack
+func verifyDurability(t *testing.T, fsys FS, ack *acknowledged) {
+	t.Helper()
+	db, err := NewDBWithOptions(durabilityPath, Options{FS: fsys, RetentionInterval: -1})
+	if err != nil {
+		if !ack.userCreated && len(ack.chirps) == 0 {
+			// nothing was acknowledged, not even the database
+			return
+		}
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+
+	user, ok := db.IdentifyUser("user@example.com", "password")
+	if ack.userCreated && !ok {
+		t.Error("acknowledged user is lost")
+	}
+	if ack.userFailed && ok {
+		t.Error("user whose creation failed is stored")
+	}
+	if ack.red && !user.IsChirpyRed {
+		t.Error("acknowledged Chirpy Red upgrade is lost")
+	}
+	if ack.redFailed && user.IsChirpyRed {
+		t.Error("failed Chirpy Red upgrade is stored")
+	}
+
+	stored := map[string]Chirp{}
+	for id, chirp := range db.data.Chirps {
+		if id != chirp.ID {
+			t.Errorf("chirp %d stored under %d", chirp.ID, id)
+		}
+		stored[chirp.Body] = chirp
+	}
+	for body, chirp := range ack.chirps {
+		got, ok := stored[body]
+		if !ok || got.ID != chirp.ID {
+			t.Errorf("acknowledged chirp %q (id %d) is lost, found %+v", body, chirp.ID, got)
+			continue
+		}
+		if got.IsDeleted() != ack.deleted[chirp.ID] {
+			t.Errorf("chirp %q deleted = %v, want %v", body, got.IsDeleted(), ack.deleted[chirp.ID])
+		}
+	}
+	for _, body := range ack.failedChirps {
+		if _, ok := stored[body]; ok {
+			t.Errorf("chirp %q whose write failed is stored", body)
+		}
+	}
+	for _, id := range ack.failedDeletes {
+		if chirp := db.data.Chirps[id]; chirp.IsDeleted() {
+			t.Errorf("chirp %d whose deletion failed is deleted", id)
+		}
+	}
+	problems, err := db.Check()
+	if err != nil || len(problems) > 0 {
+		t.Errorf("Check = %v, %v", problems, err)
+	}
+}
+
+// fail every file operation of the scenario in turn, then check that
+// the database keeps what it acknowledged and nothing else
+func TestDurabilityUnderFaults(t *testing.T) {
+	// count and classify the operations of a run without faults
+	fsys := NewFaultFS(NewMemFS())
+	if err := fsys.MkdirAll("/data", 0700); err != nil {
+		t.Fatal(err)
+	}
+	ops := []Op{}
+	fsys.SetInjector(func(op Op) *Fault {
+		ops = append(ops, op)
+		return nil
+	})
+	first := fsys.Ops() + 1
+	ack := durabilityScenario(fsys)
+	if !ack.userCreated || len(ack.chirps) != 4 || len(ack.deleted) != 1 {
+		t.Fatalf("scenario without faults acknowledged %+v", ack)
+	}
+	fsys.SetInjector(nil)
+	verifyDurability(t, fsys, ack)
+	covered := map[string]bool{}
+	for _, op := range ops {
+		switch {
+		case op.Kind == OpWrite && strings.HasSuffix(op.Name, ".log"):
+			covered["log append"] = true
+		case op.Kind == OpRename || op.Kind == OpLink:
+			covered["snapshot "+string(op.Kind)] = true
+		case op.Kind == OpWrite && strings.Contains(op.Name, ".chirps."):
+			covered["collection file write"] = true
+		}
+	}
+	for _, want := range []string{"log append", "snapshot rename", "snapshot link", "collection file write"} {
+		if !covered[want] {
+			t.Errorf("scenario never runs a %s", want)
+		}
+	}
+
+	last := first + len(ops) - 1
+	for seq := first; seq <= last; seq++ {
+		op := ops[seq-first]
+		t.Run(fmt.Sprintf("%d_%s", seq, op.Kind), func(t *testing.T) {
+			fsys := NewFaultFS(NewMemFS())
+			if err := fsys.MkdirAll("/data", 0700); err != nil {
+				t.Fatal(err)
+			}
+			fsys.SetInjector(FailAt(seq, nil))
+			ack := durabilityScenario(fsys)
+			if len(fsys.Failed()) != 1 {
+				t.Fatalf("failed %v, want operation %d (%s %s)", fsys.Failed(), seq, op.Kind, op.Name)
+			}
+			fsys.SetInjector(nil)
+			verifyDurability(t, fsys, ack)
+		})
+	}
+
+	// and tear every write, leaving part of it behind
+	writes := 0
+	for _, op := range ops {
+		if op.Kind == OpWrite {
+			writes++
+		}
+	}
+	for n := 1; n <= writes; n++ {
+		t.Run(fmt.Sprintf("torn_write_%d", n), func(t *testing.T) {
+			fsys := NewFaultFS(NewMemFS())
+			if err := fsys.MkdirAll("/data", 0700); err != nil {
+				t.Fatal(err)
+			}
+			fsys.SetInjector(FailNth(OpWrite, n, nil, 10))
+			ack := durabilityScenario(fsys)
+			fsys.SetInjector(nil)
+			verifyDurability(t, fsys, ack)
+		})
+	}
+}
@@ -0,0 +1,397 @@
+package database
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrInvalidImport = errors.New("invalid import")
+
+// record types of an NDJSON export
+const (
+	RecordUser       = "user"
+	RecordChirp      = "chirp"
+	RecordMembership = "membership"
+)
+
+const planChirpyRed = "chirpy_red"
+
+// at most this many problems are listed in an ErrInvalidImport
+const maxImportProblems = 20
+
+// ExportRecord is one line of an NDJSON export. Type names the one
+// other field that is set.
+type ExportRecord struct {
+	Type       string            `json:"type"`
+	User       *ExportUser       `json:"user,omitempty"`
+	Chirp      *Chirp            `json:"chirp,omitempty"`
+	Membership *ExportMembership `json:"membership,omitempty"`
+}
+
+// ExportUser is a user without session state. Password is the bcrypt
+// hash, so users keep their passwords across environments.
+type ExportUser struct {
+	ID       int    `json:"id"`
+	Email    string `json:"email"`
+	Password []byte `json:"password"`
+}
+
+// ExportMembership marks a user as a paying member
+type ExportMembership struct {
+	UserID int    `json:"user_id"`
+	Plan   string `json:"plan"`
+}
+
+// ImportMode says what happens to the data already in the database
+type ImportMode string
+
+const (
+	// ImportMerge adds the imported records to the existing ones.
+	// Users are matched by email, other IDs that are already taken
+	// or were handed out before get new ones. Chirps an earlier
+	// merge stored, under their own ID or a new one, are skipped, so
+	// importing the same export twice adds nothing the second time.
+	ImportMerge ImportMode = "merge"
+	// ImportReplace drops all existing users and chirps and keeps
+	// the IDs of the imported records
+	ImportReplace ImportMode = "replace"
+)
+
+// ImportResult counts what an import did
+type ImportResult struct {
+	Users          int `json:"users"`
+	Chirps         int `json:"chirps"`
+	Memberships    int `json:"memberships"`
+	MergedUsers    int `json:"merged_users"`
+	RemappedUsers  int `json:"remapped_users"`
+	RemappedChirps int `json:"remapped_chirps"`
+	// chirps a merge found already stored
+	SkippedChirps int `json:"skipped_chirps"`
+}
+
+// Export writes every user, chirp (tombstones included) and membership
+// as NDJSON, users first so that an import can resolve references in
+// a single pass. Sessions are not exported.
+func (db *DB) Export(w io.Writer) error {
+	records := []ExportRecord{}
+	// copy under the read lock, encode after releasing it so a slow
+	// reader does not hold up writers
+	err := db.View(func(tx *Tx) error {
+		memberships := []ExportRecord{}
+		for _, user := range tx.Users() {
+			records = append(records, ExportRecord{
+				Type: RecordUser,
+				User: &ExportUser{ID: user.ID, Email: user.Email, Password: user.Password},
+			})
+			if user.IsChirpyRed {
+				memberships = append(memberships, ExportRecord{
+					Type:       RecordMembership,
+					Membership: &ExportMembership{UserID: user.ID, Plan: planChirpyRed},
+				})
+			}
+		}
+		chirps := make([]Chirp, 0, len(tx.db.data.Chirps))
+		for _, chirp := range tx.db.data.Chirps {
+			chirps = append(chirps, chirp)
+		}
+		sortChirps(chirps)
+		for i := range chirps {
+			records = append(records, ExportRecord{Type: RecordChirp, Chirp: &chirps[i]})
+		}
+		records = append(records, memberships...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	buf := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buf)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return buf.Flush()
+}
+
+// Import reads an NDJSON export and stores it in one transaction. The
+// whole input is validated first; if any record is invalid nothing is
+// imported and the error wraps ErrInvalidImport.
+func (db *DB) Import(r io.Reader, mode ImportMode) (ImportResult, error) {
+	if mode != ImportMerge && mode != ImportReplace {
+		return ImportResult{}, fmt.Errorf("%w: unknown mode %q", ErrInvalidImport, mode)
+	}
+	batch, err := readImport(r)
+	if err != nil {
+		return ImportResult{}, err
+	}
+
+	result := ImportResult{}
+	err = db.Update(func(tx *Tx) error {
+		if mode == ImportReplace {
+			for _, user := range tx.Users() {
+				if err := tx.DeleteUser(user.ID); err != nil {
+					return err
+				}
+			}
+			for id := range tx.db.data.Chirps {
+				if err := tx.DeleteChirp(id); err != nil {
+					return err
+				}
+			}
+			// the sessions belong to the replaced users
+			for _, session := range tx.Sessions() {
+				if err := tx.DeleteSession(session.ID); err != nil {
+					return err
+				}
+			}
+		}
+
+		// IDs this database may already have handed out. In merge mode
+		// records at or below them get new IDs, once every record that
+		// keeps its ID has been placed.
+		userSeq := tx.Sequence(collectionUsers)
+		chirpSeq := tx.Sequence(collectionChirps)
+
+		// imported user ID -> ID in this database
+		userIDs := make(map[int]int)
+		remapUsers := []User{}
+		for _, imported := range batch.users {
+			if existing, ok := tx.UserByEmail(imported.Email); ok {
+				userIDs[imported.ID] = existing.ID
+				result.MergedUsers++
+				continue
+			}
+			user := User{ID: imported.ID, Email: NormalizeEmail(imported.Email), Password: imported.Password}
+			if mode == ImportMerge && user.ID <= userSeq {
+				remapUsers = append(remapUsers, user)
+				continue
+			}
+			if err := tx.PutUser(user); err != nil {
+				return err
+			}
+			userIDs[imported.ID] = user.ID
+			result.Users++
+		}
+		for _, user := range remapUsers {
+			importedID := user.ID
+			user.ID = tx.nextID(collectionUsers)
+			if err := tx.PutUser(user); err != nil {
+				return err
+			}
+			userIDs[importedID] = user.ID
+			result.Users++
+			result.RemappedUsers++
+		}
+
+		chirps := make([]Chirp, len(batch.chirps))
+		for i, chirp := range batch.chirps {
+			chirp.AuthorID = userIDs[chirp.AuthorID]
+			if mode == ImportMerge {
+				// the export's IDs are those of this import now
+				chirp.ImportedID = 0
+			}
+			chirps[i] = chirp
+		}
+		skip := map[int]bool{}
+		if mode == ImportMerge {
+			skip = importedBefore(tx, chirps)
+		}
+		remapChirps := []Chirp{}
+		for i, chirp := range chirps {
+			if skip[i] {
+				result.SkippedChirps++
+				continue
+			}
+			if mode == ImportMerge && chirp.ID <= chirpSeq {
+				remapChirps = append(remapChirps, chirp)
+				continue
+			}
+			if err := tx.PutChirp(chirp); err != nil {
+				return err
+			}
+			result.Chirps++
+		}
+		for _, chirp := range remapChirps {
+			chirp.ImportedID = chirp.ID
+			chirp.ID = tx.nextID(collectionChirps)
+			if err := tx.PutChirp(chirp); err != nil {
+				return err
+			}
+			result.Chirps++
+			result.RemappedChirps++
+		}
+
+		for _, membership := range batch.memberships {
+			user, _ := tx.User(userIDs[membership.UserID])
+			user.IsChirpyRed = true
+			if err := tx.PutUser(user); err != nil {
+				return err
+			}
+			result.Memberships++
+		}
+		return nil
+	})
+	if err != nil {
+		return ImportResult{}, err
+	}
+	return result, nil
+}
+
+// the indexes of the imported chirps, authors mapped to this database,
+// that an earlier merge stored: under a new ID that keeps the exported
+// one in ImportedID, or under the exported ID itself, where the body
+// tells the imported chirp from one this database wrote
+func importedBefore(tx *Tx, chirps []Chirp) map[int]bool {
+	type key struct{ authorID, importedID int }
+	remapped := make(map[key]bool)
+	for _, chirp := range tx.db.data.Chirps {
+		if chirp.ImportedID != 0 {
+			remapped[key{chirp.AuthorID, chirp.ImportedID}] = true
+		}
+	}
+	skip := make(map[int]bool)
+	for i, chirp := range chirps {
+		existing, ok := tx.db.data.Chirps[chirp.ID]
+		kept := ok && existing.ImportedID == 0 && existing.AuthorID == chirp.AuthorID && existing.Body == chirp.Body
+		if kept || remapped[key{chirp.AuthorID, chirp.ID}] {
+			skip[i] = true
+		}
+	}
+	return skip
+}
+
+// importBatch is a validated import, each collection in input order
+type importBatch struct {
+	users       []ExportUser
+	chirps      []Chirp
+	memberships []ExportMembership
+}
+
+// read and validate every record of an import. References must point
+// at users in the same input, since IDs mean nothing across databases.
+func readImport(r io.Reader) (*importBatch, error) {
+	batch := &importBatch{}
+	problems := []string{}
+	report := func(line int, format string, args ...any) {
+		problems = append(problems, fmt.Sprintf("line %d: ", line)+fmt.Sprintf(format, args...))
+	}
+
+	userIDs := make(map[int]struct{})
+	emails := make(map[string]struct{})
+	chirpIDs := make(map[int]struct{})
+	members := make(map[int]struct{})
+	type reference struct{ line, userID int }
+	authors := []reference{}
+	memberRefs := []reference{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		raw := strings.TrimSpace(scanner.Text())
+		if raw == "" {
+			continue
+		}
+		record := ExportRecord{}
+		decoder := json.NewDecoder(strings.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&record); err != nil {
+			report(line, "%v", err)
+			continue
+		}
+		switch record.Type {
+		case RecordUser:
+			user := record.User
+			if user == nil {
+				report(line, "user record without user")
+				continue
+			}
+			if user.ID <= 0 {
+				report(line, "user id must be positive")
+			} else if _, ok := userIDs[user.ID]; ok {
+				report(line, "duplicate user id %d", user.ID)
+			}
+			email := NormalizeEmail(user.Email)
+			if email == "" {
+				report(line, "user %d has no email", user.ID)
+			} else if _, ok := emails[email]; ok {
+				report(line, "duplicate email %q", user.Email)
+			}
+			if _, err := bcrypt.Cost(user.Password); err != nil {
+				report(line, "user %d has no valid password hash", user.ID)
+			}
+			userIDs[user.ID] = struct{}{}
+			emails[email] = struct{}{}
+			batch.users = append(batch.users, *user)
+		case RecordChirp:
+			chirp := record.Chirp
+			if chirp == nil {
+				report(line, "chirp record without chirp")
+				continue
+			}
+			if chirp.ID <= 0 {
+				report(line, "chirp id must be positive")
+			} else if _, ok := chirpIDs[chirp.ID]; ok {
+				report(line, "duplicate chirp id %d", chirp.ID)
+			}
+			if !chirp.IsDeleted() && chirp.Body == "" {
+				report(line, "chirp %d has no body", chirp.ID)
+			}
+			if ChirpTooLong(chirp.Body) {
+				report(line, "chirp %d is longer than %d bytes", chirp.ID, MaxChirpLength)
+			}
+			chirpIDs[chirp.ID] = struct{}{}
+			authors = append(authors, reference{line, chirp.AuthorID})
+			batch.chirps = append(batch.chirps, *chirp)
+		case RecordMembership:
+			membership := record.Membership
+			if membership == nil {
+				report(line, "membership record without membership")
+				continue
+			}
+			if membership.Plan != planChirpyRed {
+				report(line, "unknown plan %q", membership.Plan)
+			}
+			if _, ok := members[membership.UserID]; ok {
+				report(line, "duplicate membership for user %d", membership.UserID)
+			}
+			members[membership.UserID] = struct{}{}
+			memberRefs = append(memberRefs, reference{line, membership.UserID})
+			batch.memberships = append(batch.memberships, *membership)
+		default:
+			report(line, "unknown record type %q", record.Type)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, ref := range authors {
+		if _, ok := userIDs[ref.userID]; !ok {
+			report(ref.line, "chirp author %d is not in the import", ref.userID)
+		}
+	}
+	for _, ref := range memberRefs {
+		if _, ok := userIDs[ref.userID]; !ok {
+			report(ref.line, "member %d is not in the import", ref.userID)
+		}
+	}
+
+	if len(problems) > 0 {
+		more := ""
+		if len(problems) > maxImportProblems {
+			more = fmt.Sprintf(" (and %d more)", len(problems)-maxImportProblems)
+			problems = problems[:maxImportProblems]
+		}
+		return nil, fmt.Errorf("%w: %s%s", ErrInvalidImport, strings.Join(problems, "; "), more)
+	}
+	return batch, nil
+}
@@ -0,0 +1,55 @@
+package database
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestMergeImportIsIdempotent(t *testing.T) {
+	src := openTestDB(t, NewMemFS(), Options{})
+	user, err := src.CreateUser("user@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// repeated chirps are imported as often as they were written
+	for _, body := range []string{"first", "again", "again"} {
+		if _, err := src.CreateChirp(body, user.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var export bytes.Buffer
+	if err := src.Export(&export); err != nil {
+		t.Fatal(err)
+	}
+
+	// the user already chirped here, under the ID of the first
+	// exported chirp and with the body of others
+	dst := openTestDB(t, NewMemFS(), Options{})
+	existing, err := dst.CreateUser("user@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dst.CreateChirp("again", existing.ID); err != nil {
+		t.Fatal(err)
+	}
+	first, err := dst.Import(bytes.NewReader(export.Bytes()), ImportMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Chirps != 3 || first.SkippedChirps != 0 || first.RemappedChirps != 1 {
+		t.Fatalf("first import = %+v, want 3 chirps, 1 of them remapped", first)
+	}
+	chirps := dst.GetChirps()
+
+	second, err := dst.Import(bytes.NewReader(export.Bytes()), ImportMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Chirps != 0 || second.SkippedChirps != 3 || second.MergedUsers != 1 {
+		t.Errorf("second import = %+v, want 3 skipped chirps and 1 merged user", second)
+	}
+	if got := dst.GetChirps(); !reflect.DeepEqual(got, chirps) {
+		t.Errorf("second import changed the chirps to %+v, want %+v", got, chirps)
+	}
+}
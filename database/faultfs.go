@@ -0,0 +1,313 @@
+package database
+
+import (
+	"errors"
+	"io/fs"
+	"sync"
+)
+
+var ErrInjected = errors.New("injected fault")
+
+// OpKind names an operation FaultFS can fail
+type OpKind string
+
+const (
+	OpOpenFile   OpKind = "open_file"
+	OpCreateTemp OpKind = "create_temp"
+	OpReadFile   OpKind = "read_file"
+	OpStat       OpKind = "stat"
+	OpRename     OpKind = "rename"
+	OpLink       OpKind = "link"
+	OpRemove     OpKind = "remove"
+	OpChmod      OpKind = "chmod"
+	OpMkdirAll   OpKind = "mkdir_all"
+	OpReadDir    OpKind = "read_dir"
+	OpSyncDir    OpKind = "sync_dir"
+	OpLock       OpKind = "lock"
+	OpRead       OpKind = "read"
+	OpWrite      OpKind = "write"
+	OpSeek       OpKind = "seek"
+	OpFileStat   OpKind = "file_stat"
+	OpSync       OpKind = "sync"
+	OpTruncate   OpKind = "truncate"
+	OpClose      OpKind = "close"
+)
+
+// Op is one operation seen by FaultFS
+type Op struct {
+	// Seq numbers the operations from 1 in the order they ran
+	Seq  int
+	Kind OpKind
+	Name string
+}
+
+// Fault is a failure injected into an operation
+type Fault struct {
+	Err error
+	// bytes a failing write still writes, to simulate torn writes
+	Partial int
+}
+
+// Injector decides for every operation whether it fails
+type Injector func(op Op) *Fault
+
+// FaultFS wraps an FS and fails the operations its injector picks. A
+// durability test runs a scenario once to count its operations with
+// Ops, then again failing each of them in turn with FailAt.
+type FaultFS struct {
+	base FS
+
+	mu     sync.Mutex
+	inject Injector
+	seq    int
+	failed []Op
+}
+
+var _ FS = (*FaultFS)(nil)
+
+// NewFaultFS wraps base, failing nothing until SetInjector is called
+func NewFaultFS(base FS) *FaultFS {
+	return &FaultFS{base: base}
+}
+
+// SetInjector replaces the injector, nil fails nothing
+func (f *FaultFS) SetInjector(inject Injector) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inject = inject
+}
+
+// Ops returns the number of operations run so far
+func (f *FaultFS) Ops() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.seq
+}
+
+// Failed returns the operations that were failed so far
+func (f *FaultFS) Failed() []Op {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Op(nil), f.failed...)
+}
+
+// FailAt fails the operation with sequence number seq with err
+func FailAt(seq int, err error) Injector {
+	return func(op Op) *Fault {
+		if op.Seq != seq {
+			return nil
+		}
+		return &Fault{Err: err}
+	}
+}
+
+// FailNth fails the nth operation of kind, counting from 1, with err.
+// A failing write writes partial bytes first.
+func FailNth(kind OpKind, n int, err error, partial int) Injector {
+	seen := 0
+	return func(op Op) *Fault {
+		if op.Kind != kind {
+			return nil
+		}
+		seen++
+		if seen != n {
+			return nil
+		}
+		return &Fault{Err: err, Partial: partial}
+	}
+}
+
+// FailAll fails every operation of kind with err
+func FailAll(kind OpKind, err error) Injector {
+	return func(op Op) *Fault {
+		if op.Kind != kind {
+			return nil
+		}
+		return &Fault{Err: err}
+	}
+}
+
+// count an operation and return the fault to inject, if any
+func (f *FaultFS) before(kind OpKind, name string) *Fault {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seq++
+	if f.inject == nil {
+		return nil
+	}
+	op := Op{Seq: f.seq, Kind: kind, Name: name}
+	fault := f.inject(op)
+	if fault == nil {
+		return nil
+	}
+	if fault.Err == nil {
+		fault.Err = ErrInjected
+	}
+	f.failed = append(f.failed, op)
+	return fault
+}
+
+func faultError(op OpKind, name string, fault *Fault) error {
+	return &fs.PathError{Op: string(op), Path: name, Err: fault.Err}
+}
+
+func (f *FaultFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if fault := f.before(OpOpenFile, name); fault != nil {
+		return nil, faultError(OpOpenFile, name, fault)
+	}
+	file, err := f.base.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{fs: f, File: file}, nil
+}
+
+func (f *FaultFS) CreateTemp(dir, pattern string) (File, error) {
+	if fault := f.before(OpCreateTemp, dir); fault != nil {
+		return nil, faultError(OpCreateTemp, dir, fault)
+	}
+	file, err := f.base.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{fs: f, File: file}, nil
+}
+
+func (f *FaultFS) ReadFile(name string) ([]byte, error) {
+	if fault := f.before(OpReadFile, name); fault != nil {
+		return nil, faultError(OpReadFile, name, fault)
+	}
+	return f.base.ReadFile(name)
+}
+
+func (f *FaultFS) Stat(name string) (fs.FileInfo, error) {
+	if fault := f.before(OpStat, name); fault != nil {
+		return nil, faultError(OpStat, name, fault)
+	}
+	return f.base.Stat(name)
+}
+
+func (f *FaultFS) Rename(oldpath, newpath string) error {
+	if fault := f.before(OpRename, oldpath); fault != nil {
+		return faultError(OpRename, oldpath, fault)
+	}
+	return f.base.Rename(oldpath, newpath)
+}
+
+func (f *FaultFS) Link(oldname, newname string) error {
+	if fault := f.before(OpLink, oldname); fault != nil {
+		return faultError(OpLink, oldname, fault)
+	}
+	return f.base.Link(oldname, newname)
+}
+
+func (f *FaultFS) Remove(name string) error {
+	if fault := f.before(OpRemove, name); fault != nil {
+		return faultError(OpRemove, name, fault)
+	}
+	return f.base.Remove(name)
+}
+
+func (f *FaultFS) Chmod(name string, mode fs.FileMode) error {
+	if fault := f.before(OpChmod, name); fault != nil {
+		return faultError(OpChmod, name, fault)
+	}
+	return f.base.Chmod(name, mode)
+}
+
+func (f *FaultFS) MkdirAll(path string, perm fs.FileMode) error {
+	if fault := f.before(OpMkdirAll, path); fault != nil {
+		return faultError(OpMkdirAll, path, fault)
+	}
+	return f.base.MkdirAll(path, perm)
+}
+
+func (f *FaultFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if fault := f.before(OpReadDir, name); fault != nil {
+		return nil, faultError(OpReadDir, name, fault)
+	}
+	return f.base.ReadDir(name)
+}
+
+func (f *FaultFS) SyncDir(dir string) error {
+	if fault := f.before(OpSyncDir, dir); fault != nil {
+		return faultError(OpSyncDir, dir, fault)
+	}
+	return f.base.SyncDir(dir)
+}
+
+func (f *FaultFS) Lock(file File) error {
+	if fault := f.before(OpLock, file.Name()); fault != nil {
+		return faultError(OpLock, file.Name(), fault)
+	}
+	if wrapped, ok := file.(*faultFile); ok {
+		file = wrapped.File
+	}
+	return f.base.Lock(file)
+}
+
+func (f *FaultFS) SameFile(a, b fs.FileInfo) bool {
+	return f.base.SameFile(a, b)
+}
+
+// faultFile is an open file of FaultFS
+type faultFile struct {
+	File
+	fs *FaultFS
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if fault := f.fs.before(OpRead, f.Name()); fault != nil {
+		return 0, faultError(OpRead, f.Name(), fault)
+	}
+	return f.File.Read(p)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if fault := f.fs.before(OpWrite, f.Name()); fault != nil {
+		n := 0
+		if partial := min(fault.Partial, len(p)); partial > 0 {
+			n, _ = f.File.Write(p[:partial])
+		}
+		return n, faultError(OpWrite, f.Name(), fault)
+	}
+	return f.File.Write(p)
+}
+
+func (f *faultFile) Seek(offset int64, whence int) (int64, error) {
+	if fault := f.fs.before(OpSeek, f.Name()); fault != nil {
+		return 0, faultError(OpSeek, f.Name(), fault)
+	}
+	return f.File.Seek(offset, whence)
+}
+
+func (f *faultFile) Stat() (fs.FileInfo, error) {
+	if fault := f.fs.before(OpFileStat, f.Name()); fault != nil {
+		return nil, faultError(OpFileStat, f.Name(), fault)
+	}
+	return f.File.Stat()
+}
+
+func (f *faultFile) Sync() error {
+	if fault := f.fs.before(OpSync, f.Name()); fault != nil {
+		return faultError(OpSync, f.Name(), fault)
+	}
+	return f.File.Sync()
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if fault := f.fs.before(OpTruncate, f.Name()); fault != nil {
+		return faultError(OpTruncate, f.Name(), fault)
+	}
+	return f.File.Truncate(size)
+}
+
+// a failed close still releases the file, as close(2) does
+func (f *faultFile) Close() error {
+	fault := f.fs.before(OpClose, f.Name())
+	err := f.File.Close()
+	if fault != nil {
+		return faultError(OpClose, f.Name(), fault)
+	}
+	return err
+}
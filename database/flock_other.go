@@ -0,0 +1,11 @@
+//go:build !unix
+
+package database
+
+import "os"
+
+// advisory locks are only implemented on unix, elsewhere
+// the lock file is created but not actually locked
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,115 @@
+package database
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Binary snapshots behind gobValuesMagic hold gob encoded Go values of
+// whatever shape the types had when the file was written. gob drops
+// fields the decoding type lacks, so they are decoded through the
+// frozen types below, which hold every field any schema version had,
+// and turned into the JSON data migrations work on. Never remove a
+// field from them.
+
+type gobUser struct {
+	ID       int    `json:"id"`
+	Email    string `json:"email"`
+	Password []byte `json:"password"`
+	// until migration 3
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IsChirpyRed  bool   `json:"is_chirpy_red"`
+}
+
+type gobChirp struct {
+	ID        int        `json:"id"`
+	Body      string     `json:"body"`
+	AuthorID  int        `json:"author_id"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// refresh tokens of schema version 3, see legacyCollectionTokens
+type gobToken struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Token     string    `json:"token"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type gobSession struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"user_id"`
+	TokenHash  string    `json:"token_hash"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	// from migration 5
+	ExpiresAt          *time.Time `json:"expires_at,omitempty"`
+	UserAgent          string     `json:"user_agent,omitempty"`
+	IP                 string     `json:"ip,omitempty"`
+	RotatedTokenHashes []string   `json:"rotated_token_hashes,omitempty"`
+}
+
+type gobData struct {
+	Chirps    map[int]gobChirp   `json:"chirps,omitempty"`
+	Users     map[int]gobUser    `json:"users,omitempty"`
+	Tokens    map[int]gobToken   `json:"tokens,omitempty"`
+	Sessions  map[int]gobSession `json:"sessions,omitempty"`
+	Sequences map[string]int     `json:"sequences,omitempty"`
+	ChangeSeq int64              `json:"change_seq,omitempty"`
+}
+
+type gobManifest struct {
+	Generation  int            `json:"generation"`
+	Collections []string       `json:"collections"`
+	Sequences   map[string]int `json:"sequences,omitempty"`
+	ChangeSeq   int64          `json:"change_seq,omitempty"`
+}
+
+func decodeGobValuesSnapshot(raw []byte, keyID string) (snapshotFile, error) {
+	binary, err := decodeBinaryEnvelope(raw)
+	if err != nil {
+		return snapshotFile{}, err
+	}
+	var value any
+	switch binary.Layout {
+	case layoutSingle:
+		value = &gobData{}
+	case layoutManifest:
+		value = &gobManifest{}
+	case layoutCollection:
+		switch binary.Collection {
+		case collectionUsers:
+			value = &map[int]gobUser{}
+		case collectionChirps:
+			value = &map[int]gobChirp{}
+		case legacyCollectionTokens:
+			value = &map[int]gobToken{}
+		case collectionSessions:
+			value = &map[int]gobSession{}
+		default:
+			return snapshotFile{}, fmt.Errorf("unknown collection %q", binary.Collection)
+		}
+	default:
+		return snapshotFile{}, fmt.Errorf("unknown snapshot layout %q", binary.Layout)
+	}
+	if err := gob.NewDecoder(bytes.NewReader(binary.BinaryData)).Decode(value); err != nil {
+		return snapshotFile{}, err
+	}
+	compactData, err := json.Marshal(value)
+	if err != nil {
+		return snapshotFile{}, err
+	}
+	return snapshotFile{
+		Version:    binary.Version,
+		Layout:     binary.Layout,
+		Collection: binary.Collection,
+		Checksum:   checksum(compactData),
+		Data:       compactData,
+		keyID:      keyID,
+		format:     FormatBinary,
+		gobValues:  true,
+	}, nil
+}
@@ -0,0 +1,154 @@
+package database
+
+// indexes are the secondary lookups kept next to DB.data. They are
+// rebuilt on load and updated by the put and delete helpers below, so
+// every mutation must go through those. Each index belongs to one
+// collection and is guarded by that collection's lock.
+type indexes struct {
+	userByEmail        map[string]int
+	chirpsByAuthor     map[int]map[int]struct{}
+	sessionByTokenHash map[string]int
+	// the sessions by the hashes of their rotated tokens
+	sessionByRotatedHash map[string]int
+	sessionsByUser       map[int]map[int]struct{}
+}
+
+func buildIndexes(data *DbData) *indexes {
+	idx := &indexes{
+		userByEmail:          make(map[string]int),
+		chirpsByAuthor:       make(map[int]map[int]struct{}),
+		sessionByTokenHash:   make(map[string]int),
+		sessionByRotatedHash: make(map[string]int),
+		sessionsByUser:       make(map[int]map[int]struct{}),
+	}
+	for id, user := range data.Users {
+		// older files may hold duplicate emails, the oldest user keeps it
+		if existing, ok := idx.userByEmail[NormalizeEmail(user.Email)]; ok && existing < id {
+			continue
+		}
+		idx.addUser(id, user)
+	}
+	for id, chirp := range data.Chirps {
+		idx.addChirp(id, chirp)
+	}
+	for id, session := range data.Sessions {
+		// a duplicate hash is reported by Check, the oldest session keeps it
+		if existing, ok := idx.sessionByTokenHash[session.TokenHash]; ok && existing < id {
+			addToSet(idx.sessionsByUser, session.UserID, id)
+			continue
+		}
+		idx.addSession(id, session)
+	}
+	return idx
+}
+
+func addToSet(sets map[int]map[int]struct{}, key, id int) {
+	ids, ok := sets[key]
+	if !ok {
+		ids = make(map[int]struct{})
+		sets[key] = ids
+	}
+	ids[id] = struct{}{}
+}
+
+func removeFromSet(sets map[int]map[int]struct{}, key, id int) {
+	ids := sets[key]
+	delete(ids, id)
+	if len(ids) == 0 {
+		delete(sets, key)
+	}
+}
+
+// emails are indexed normalized, older files may hold them as typed
+func (idx *indexes) addUser(id int, user User) {
+	idx.userByEmail[NormalizeEmail(user.Email)] = id
+}
+
+func (idx *indexes) removeUser(id int, user User) {
+	email := NormalizeEmail(user.Email)
+	if idx.userByEmail[email] == id {
+		delete(idx.userByEmail, email)
+	}
+}
+
+func (idx *indexes) addChirp(id int, chirp Chirp) {
+	if chirp.IsDeleted() {
+		return
+	}
+	addToSet(idx.chirpsByAuthor, chirp.AuthorID, id)
+}
+
+func (idx *indexes) removeChirp(id int, chirp Chirp) {
+	removeFromSet(idx.chirpsByAuthor, chirp.AuthorID, id)
+}
+
+func (idx *indexes) addSession(id int, session Session) {
+	idx.sessionByTokenHash[session.TokenHash] = id
+	for _, hash := range session.RotatedTokenHashes {
+		idx.sessionByRotatedHash[hash] = id
+	}
+	addToSet(idx.sessionsByUser, session.UserID, id)
+}
+
+func (idx *indexes) removeSession(id int, session Session) {
+	if idx.sessionByTokenHash[session.TokenHash] == id {
+		delete(idx.sessionByTokenHash, session.TokenHash)
+	}
+	for _, hash := range session.RotatedTokenHashes {
+		if idx.sessionByRotatedHash[hash] == id {
+			delete(idx.sessionByRotatedHash, hash)
+		}
+	}
+	removeFromSet(idx.sessionsByUser, session.UserID, id)
+}
+
+// store user in DB.data and keep the indexes in sync
+func (db *DB) putUser(user User) {
+	if old, ok := db.data.Users[user.ID]; ok {
+		db.index.removeUser(user.ID, old)
+	}
+	db.data.Users[user.ID] = user
+	db.index.addUser(user.ID, user)
+}
+
+// store chirp in DB.data and keep the indexes in sync
+func (db *DB) putChirp(chirp Chirp) {
+	if old, ok := db.data.Chirps[chirp.ID]; ok {
+		db.index.removeChirp(chirp.ID, old)
+	}
+	db.data.Chirps[chirp.ID] = chirp
+	db.index.addChirp(chirp.ID, chirp)
+}
+
+// store session in DB.data and keep the indexes in sync
+func (db *DB) putSession(session Session) {
+	if old, ok := db.data.Sessions[session.ID]; ok {
+		db.index.removeSession(session.ID, old)
+	}
+	db.data.Sessions[session.ID] = session
+	db.index.addSession(session.ID, session)
+}
+
+// remove user from DB.data and the indexes
+func (db *DB) deleteUser(id int) {
+	if old, ok := db.data.Users[id]; ok {
+		db.index.removeUser(id, old)
+		delete(db.data.Users, id)
+	}
+}
+
+// remove chirp from DB.data and the indexes
+func (db *DB) deleteChirp(id int) {
+	if old, ok := db.data.Chirps[id]; ok {
+		db.index.removeChirp(id, old)
+		delete(db.data.Chirps, id)
+	}
+}
+
+// remove session from DB.data and the indexes
+func (db *DB) deleteSession(id int) {
+	if old, ok := db.data.Sessions[id]; ok {
+		db.index.removeSession(id, old)
+		delete(db.data.Sessions, id)
+	}
+}
@@ -0,0 +1,102 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var ErrLocked = errors.New("database is locked by another process")
+
+var ErrModifiedExternally = errors.New("database file was modified by another process")
+
+func lockPath(path string) string {
+	return path + ".lock"
+}
+
+// lock path.lock exclusively so a second process cannot open the same
+// database. The lock is released when the file is closed or the
+// process exits.
+func acquireLock(fsys FS, path string) (File, error) {
+	f, err := fsys.OpenFile(lockPath(path), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := fsys.Lock(f); err != nil {
+		f.Close()
+		return nil, lockError(fsys, path, err)
+	}
+	// record the holder for whoever finds the lock taken
+	if err := f.Truncate(0); err == nil {
+		fmt.Fprintf(f, "%d\n", os.Getpid())
+	}
+	return f, nil
+}
+
+// lock path.lock like acquireLock, but without creating or writing the
+// lock file, for readers that must leave the database untouched.
+// Without a lock file the database was never opened and nil is
+// returned.
+func acquireReadLock(fsys FS, path string) (File, error) {
+	f, err := fsys.OpenFile(lockPath(path), os.O_RDONLY, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := fsys.Lock(f); err != nil {
+		f.Close()
+		return nil, lockError(fsys, path, err)
+	}
+	return f, nil
+}
+
+// name the process holding the lock of path if err says it is taken
+func lockError(fsys FS, path string, err error) error {
+	if !errors.Is(err, ErrLocked) {
+		return err
+	}
+	holder, _ := fsys.ReadFile(lockPath(path))
+	return fmt.Errorf("%w (pid %s holds %s)", ErrLocked, strings.TrimSpace(string(holder)), lockPath(path))
+}
+
+// remember the snapshot file as it is on disk after we read or wrote it
+func (db *DB) recordSnapshotState() {
+	info, err := db.fsys.Stat(db.path)
+	if err != nil {
+		db.snapshotInfo = nil
+		return
+	}
+	db.snapshotInfo = info
+}
+
+// fail with ErrModifiedExternally if the snapshot or the log changed on
+// disk since this DB last read or wrote them
+func (db *DB) checkUnmodified() error {
+	if db.snapshotInfo != nil {
+		info, err := db.fsys.Stat(db.path)
+		if err != nil || !sameFileState(db.fsys, info, db.snapshotInfo) {
+			return fmt.Errorf("%w: %s", ErrModifiedExternally, db.path)
+		}
+	}
+	if db.log != nil {
+		info, err := db.fsys.Stat(logPath(db.path))
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrModifiedExternally, logPath(db.path))
+		}
+		openInfo, err := db.log.Stat()
+		if err != nil {
+			return err
+		}
+		if !db.fsys.SameFile(info, openInfo) || info.Size() != db.logSize {
+			return fmt.Errorf("%w: %s", ErrModifiedExternally, logPath(db.path))
+		}
+	}
+	return nil
+}
+
+func sameFileState(fsys FS, a, b os.FileInfo) bool {
+	return fsys.SameFile(a, b) && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
@@ -0,0 +1,258 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Each collection is written to its own file, named after the
+// collection and a generation that every snapshot increments. The file
+// at the database path is a manifest naming the generation and the
+// collections it consists of, and it is written last, so replacing it
+// switches all collections to the new generation at once. Files of the
+// generations the manifest backups refer to are kept, older ones are
+// removed. The log stays shared: the records of one transaction reach
+// it in a single write whatever collections they touch.
+type manifest struct {
+	Generation  int            `json:"generation"`
+	Collections []string       `json:"collections"`
+	Sequences   map[string]int `json:"sequences"`
+	ChangeSeq   int64          `json:"change_seq"`
+}
+
+// storedDB is a snapshot as read from disk: a manifest and its
+// collection files, or a single file holding everything
+type storedDB struct {
+	manifest snapshotFile
+	// nil for the single-file layout
+	collections map[string]snapshotFile
+	generation  int
+}
+
+func collectionPath(path, collection string, generation int) string {
+	return fmt.Sprintf("%s.%s.%d", path, collection, generation)
+}
+
+// write data as a new generation of collection files and a manifest
+// pointing at them, returning the new generation
+func writeCollections(fsys FS, path string, data *DbData, generation int, format SnapshotFormat, keys *keyring, backups int) (int, error) {
+	generation++
+	for _, collection := range collections {
+		raw, err := encodeSnapshotFile(snapshotFile{
+			Layout:     layoutCollection,
+			Collection: collection,
+		}, data.collection(collection), format, keys)
+		if err != nil {
+			return 0, err
+		}
+		err = writeFileAtomic(fsys, collectionPath(path, collection, generation), raw, 0)
+		if err != nil {
+			return 0, err
+		}
+	}
+	raw, err := encodeSnapshotFile(snapshotFile{Layout: layoutManifest}, manifest{
+		Generation:  generation,
+		Collections: collections,
+		Sequences:   data.Sequences,
+		ChangeSeq:   data.ChangeSeq,
+	}, format, keys)
+	if err != nil {
+		return 0, err
+	}
+	if err := writeFileAtomic(fsys, path, raw, backups); err != nil {
+		return 0, err
+	}
+	// path.N refers to generation-N at the latest. Failing to clean
+	// up only leaves files behind.
+	if err := removeGenerations(fsys, path, generation-backups); err != nil {
+		log.Printf("database: cannot remove old collection files: %v", err)
+	}
+	return generation, nil
+}
+
+// remove the collection files of generations before keep
+func removeGenerations(fsys FS, path string, keep int) error {
+	files, err := collectionFiles(fsys, path)
+	if err != nil {
+		return err
+	}
+	for name, generation := range files {
+		if generation >= keep {
+			continue
+		}
+		err := fsys.Remove(name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// highest generation of the collection files next to path, so that a
+// single file restored over a split database is not written as a
+// generation whose files are still around
+func latestGeneration(fsys FS, path string) (int, error) {
+	files, err := collectionFiles(fsys, path)
+	if err != nil {
+		return 0, err
+	}
+	latest := 0
+	for _, generation := range files {
+		latest = max(latest, generation)
+	}
+	return latest, nil
+}
+
+// the collection files of the database at path by their generation
+func collectionFiles(fsys FS, path string) (map[string]int, error) {
+	entries, err := fsys.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	base := filepath.Base(path)
+	files := make(map[string]int)
+	for _, entry := range entries {
+		for _, collection := range append(collections, retiredCollections...) {
+			suffix, ok := strings.CutPrefix(entry.Name(), base+"."+collection+".")
+			if !ok {
+				continue
+			}
+			if generation, err := strconv.Atoi(suffix); err == nil {
+				files[filepath.Join(filepath.Dir(path), entry.Name())] = generation
+			}
+		}
+	}
+	return files, nil
+}
+
+// read the database at path, falling back to the newest readable
+// backup generation when the manifest or one of its collection files
+// is corrupt
+func readStoredWithFallback(fsys FS, path string, backups int, keys *keyring) (storedDB, error) {
+	stored, err := readStored(fsys, path, path, keys)
+	if err == nil {
+		return stored, nil
+	}
+	// a missing key or a file not encrypted with the configured one
+	// is a configuration error and a failed read may pass, neither is
+	// corruption: falling back would silently serve an older backup,
+	// which the next snapshot then makes permanent
+	if errors.Is(err, ErrNoKey) || errors.Is(err, ErrNotEncrypted) || isReadError(err) {
+		return storedDB{}, err
+	}
+	for generation := 1; generation <= backups; generation++ {
+		backup := backupPath(path, generation)
+		stored, backupErr := readStored(fsys, path, backup, keys)
+		if backupErr != nil {
+			continue
+		}
+		log.Printf("database: %s is unreadable (%v), recovered from %s", path, err, backup)
+		return stored, nil
+	}
+	return storedDB{}, err
+}
+
+// whether err is a file that could not be read, rather than one that
+// is missing or does not decode
+func isReadError(err error) bool {
+	var pathErr *fs.PathError
+	return errors.As(err, &pathErr) && !errors.Is(err, fs.ErrNotExist)
+}
+
+// read the manifest or single file at file and the collection files
+// of the database at path it refers to
+func readStored(fsys FS, path, file string, keys *keyring) (storedDB, error) {
+	snapshot, err := readSnapshot(fsys, file, keys)
+	if err != nil {
+		return storedDB{}, err
+	}
+	stored := storedDB{manifest: snapshot}
+	switch snapshot.Layout {
+	case layoutSingle:
+		return stored, nil
+	case layoutManifest:
+	default:
+		return storedDB{}, fmt.Errorf("%s: not a database manifest", file)
+	}
+	m := manifest{}
+	if err := snapshot.decode(&m); err != nil {
+		return storedDB{}, fmt.Errorf("%s: %w", file, err)
+	}
+	stored.generation = m.Generation
+	stored.collections = make(map[string]snapshotFile, len(m.Collections))
+	for _, collection := range m.Collections {
+		name := collectionPath(path, collection, m.Generation)
+		snapshot, err := readSnapshot(fsys, name, keys)
+		if err != nil {
+			return storedDB{}, err
+		}
+		if snapshot.Layout != layoutCollection || snapshot.Collection != collection || snapshot.Version != stored.manifest.Version {
+			return storedDB{}, fmt.Errorf("%s: does not belong to %s", name, file)
+		}
+		stored.collections[collection] = snapshot
+	}
+	return stored, nil
+}
+
+// the stored data at the current schema version
+func (stored storedDB) decodeData() (*DbData, error) {
+	if stored.collections == nil {
+		return stored.manifest.decodeData()
+	}
+	m := manifest{}
+	if err := stored.manifest.decode(&m); err != nil {
+		return nil, err
+	}
+	data := newDbData()
+	data.Sequences = m.Sequences
+	data.ChangeSeq = m.ChangeSeq
+	for collection, snapshot := range stored.collections {
+		value := data.collection(collection)
+		if value == nil {
+			return nil, fmt.Errorf("unknown collection %q", collection)
+		}
+		if err := snapshot.decode(value); err != nil {
+			return nil, err
+		}
+	}
+	data.fillMaps()
+	return data, nil
+}
+
+// the stored data as one document, for migrations
+func (stored storedDB) document() (document, error) {
+	doc, err := stored.manifest.document()
+	if err != nil || stored.collections == nil {
+		return doc, err
+	}
+	delete(doc, "generation")
+	delete(doc, "collections")
+	for collection, snapshot := range stored.collections {
+		value, err := snapshot.document()
+		if err != nil {
+			return nil, err
+		}
+		doc[collection] = map[string]any(value)
+	}
+	return doc, nil
+}
+
+// whether any stored file is encrypted with another key than keyID,
+// or written in another format than format
+func (stored storedDB) differs(keyID string, format SnapshotFormat) (reencrypt, reformat bool) {
+	files := []snapshotFile{stored.manifest}
+	for _, snapshot := range stored.collections {
+		files = append(files, snapshot)
+	}
+	for _, snapshot := range files {
+		reencrypt = reencrypt || snapshot.keyID != keyID
+		reformat = reformat || snapshot.format != format || snapshot.gobValues
+	}
+	return reencrypt, reformat
+}
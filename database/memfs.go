@@ -0,0 +1,421 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemFS is an FS held entirely in memory. Hard links share their
+// content like on disk, and files stay readable through open handles
+// after being removed or renamed over. Sync is a no-op.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memInode
+	dirs  map[string]struct{}
+	// lock holder per inode
+	locks map[*memInode]*memFile
+	temps int
+}
+
+var _ FS = (*MemFS)(nil)
+
+type memInode struct {
+	data    []byte
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memInode),
+		dirs:  map[string]struct{}{".": {}, "/": {}},
+		locks: make(map[*memInode]*memFile),
+	}
+}
+
+func memPathError(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// fail unless the directory holding name exists; m.mu must be held
+func (m *MemFS) checkParent(op, name string) error {
+	if _, ok := m.dirs[filepath.Dir(name)]; !ok {
+		return memPathError(op, name, fs.ErrNotExist)
+	}
+	return nil
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	inode, ok := m.files[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, memPathError("open", name, fs.ErrExist)
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, memPathError("open", name, fs.ErrNotExist)
+	case !ok:
+		if _, isDir := m.dirs[name]; isDir {
+			return nil, memPathError("open", name, fs.ErrExist)
+		}
+		if err := m.checkParent("open", name); err != nil {
+			return nil, err
+		}
+		inode = &memInode{mode: perm, modTime: time.Now()}
+		m.files[name] = inode
+	}
+	if flag&os.O_TRUNC != 0 {
+		inode.data = nil
+		inode.modTime = time.Now()
+	}
+	return &memFile{fs: m, name: name, inode: inode, flag: flag}, nil
+}
+
+func (m *MemFS) CreateTemp(dir, pattern string) (File, error) {
+	for {
+		m.mu.Lock()
+		m.temps++
+		suffix := fmt.Sprint(m.temps)
+		m.mu.Unlock()
+		name := strings.Replace(pattern, "*", suffix, 1)
+		if !strings.Contains(pattern, "*") {
+			name = pattern + suffix
+		}
+		f, err := m.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
+		if err == nil || !errors.Is(err, fs.ErrExist) {
+			return f, err
+		}
+	}
+}
+
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	inode, ok := m.files[name]
+	if !ok {
+		return nil, memPathError("open", name, fs.ErrNotExist)
+	}
+	return append([]byte(nil), inode.data...), nil
+}
+
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if inode, ok := m.files[name]; ok {
+		return inode.info(name), nil
+	}
+	if _, ok := m.dirs[name]; ok {
+		return memFileInfo{name: filepath.Base(name), mode: fs.ModeDir | 0700}, nil
+	}
+	return nil, memPathError("stat", name, fs.ErrNotExist)
+}
+
+func (m *MemFS) Rename(oldpath, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	inode, ok := m.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	if err := m.checkParent("rename", newpath); err != nil {
+		return err
+	}
+	delete(m.files, oldpath)
+	m.files[newpath] = inode
+	return nil
+}
+
+func (m *MemFS) Link(oldname, newname string) error {
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	inode, ok := m.files[oldname]
+	if !ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: fs.ErrNotExist}
+	}
+	if _, exists := m.files[newname]; exists {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: fs.ErrExist}
+	}
+	if err := m.checkParent("link", newname); err != nil {
+		return err
+	}
+	m.files[newname] = inode
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if _, ok := m.dirs[name]; ok {
+		if len(m.children(name)) > 0 {
+			return memPathError("remove", name, fs.ErrInvalid)
+		}
+		delete(m.dirs, name)
+		return nil
+	}
+	return memPathError("remove", name, fs.ErrNotExist)
+}
+
+func (m *MemFS) Chmod(name string, mode fs.FileMode) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	inode, ok := m.files[name]
+	if !ok {
+		return memPathError("chmod", name, fs.ErrNotExist)
+	}
+	inode.mode = mode.Perm()
+	return nil
+}
+
+func (m *MemFS) MkdirAll(path string, perm fs.FileMode) error {
+	path = filepath.Clean(path)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if _, ok := m.files[dir]; ok {
+			return memPathError("mkdir", dir, fs.ErrExist)
+		}
+		m.dirs[dir] = struct{}{}
+		if parent := filepath.Dir(dir); parent == dir {
+			return nil
+		}
+	}
+}
+
+func (m *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.dirs[name]; !ok {
+		return nil, memPathError("open", name, fs.ErrNotExist)
+	}
+	entries := []fs.DirEntry{}
+	for _, child := range m.children(name) {
+		if inode, ok := m.files[child]; ok {
+			entries = append(entries, fs.FileInfoToDirEntry(inode.info(child)))
+		} else {
+			entries = append(entries, fs.FileInfoToDirEntry(memFileInfo{name: filepath.Base(child), mode: fs.ModeDir | 0700}))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// paths of the files and directories directly inside dir; m.mu must be held
+func (m *MemFS) children(dir string) []string {
+	children := []string{}
+	for name := range m.files {
+		if filepath.Dir(name) == dir {
+			children = append(children, name)
+		}
+	}
+	for name := range m.dirs {
+		if name != dir && filepath.Dir(name) == dir {
+			children = append(children, name)
+		}
+	}
+	return children
+}
+
+func (m *MemFS) SyncDir(dir string) error {
+	dir = filepath.Clean(dir)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.dirs[dir]; !ok {
+		return memPathError("sync", dir, fs.ErrNotExist)
+	}
+	return nil
+}
+
+func (m *MemFS) Lock(f File) error {
+	file, ok := f.(*memFile)
+	if !ok || file.fs != m {
+		return errors.New("MemFS can only lock its own files")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if holder, ok := m.locks[file.inode]; ok && holder != file {
+		return ErrLocked
+	}
+	m.locks[file.inode] = file
+	return nil
+}
+
+func (m *MemFS) SameFile(a, b fs.FileInfo) bool {
+	aInfo, aOK := a.(memFileInfo)
+	bInfo, bOK := b.(memFileInfo)
+	return aOK && bOK && aInfo.inode != nil && aInfo.inode == bInfo.inode
+}
+
+func (inode *memInode) info(name string) memFileInfo {
+	return memFileInfo{
+		name:    filepath.Base(name),
+		size:    int64(len(inode.data)),
+		mode:    inode.mode,
+		modTime: inode.modTime,
+		inode:   inode,
+	}
+}
+
+// memFileInfo is the fs.FileInfo of MemFS, a snapshot taken by Stat
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+	inode   *memInode
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi memFileInfo) Sys() any           { return nil }
+
+// memFile is an open file of MemFS
+type memFile struct {
+	fs     *MemFS
+	name   string
+	inode  *memInode
+	flag   int
+	offset int64
+	closed bool
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+// fail once the file is closed; f.fs.mu must be held
+func (f *memFile) check(op string) error {
+	if f.closed {
+		return memPathError(op, f.name, fs.ErrClosed)
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("read"); err != nil {
+		return 0, err
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == os.O_WRONLY {
+		return 0, memPathError("read", f.name, fs.ErrPermission)
+	}
+	if f.offset >= int64(len(f.inode.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.inode.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("write"); err != nil {
+		return 0, err
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, memPathError("write", f.name, fs.ErrPermission)
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.inode.data))
+	}
+	end := f.offset + int64(len(p))
+	if end > int64(len(f.inode.data)) {
+		f.inode.data = append(f.inode.data, make([]byte, end-int64(len(f.inode.data)))...)
+	}
+	copy(f.inode.data[f.offset:], p)
+	f.offset = end
+	f.inode.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("seek"); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.inode.data))
+	default:
+		return 0, memPathError("seek", f.name, fs.ErrInvalid)
+	}
+	if offset < 0 {
+		return 0, memPathError("seek", f.name, fs.ErrInvalid)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("stat"); err != nil {
+		return nil, err
+	}
+	return f.inode.info(f.name), nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return f.check("sync")
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("truncate"); err != nil {
+		return err
+	}
+	if size < 0 {
+		return memPathError("truncate", f.name, fs.ErrInvalid)
+	}
+	if size <= int64(len(f.inode.data)) {
+		f.inode.data = f.inode.data[:size]
+	} else {
+		f.inode.data = append(f.inode.data, make([]byte, size-int64(len(f.inode.data)))...)
+	}
+	f.inode.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("close"); err != nil {
+		return err
+	}
+	f.closed = true
+	if f.fs.locks[f.inode] == f {
+		delete(f.fs.locks, f.inode)
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package database
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MemStore is a Store that keeps everything in memory and never
+// touches disk, for tests and ephemeral dev servers
+type MemStore struct {
+	mux  *sync.RWMutex
+	data *DbData
+}
+
+// NewMemStore creates an empty in-memory store
+func NewMemStore() *MemStore {
+	return &MemStore{
+		mux:  &sync.RWMutex{},
+		data: newDbData(),
+	}
+}
+
+func (s *MemStore) CreateChirp(msg string, authorID int) (Chirp, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	newChirp := Chirp{
+		ID:       s.nextID(collectionChirps),
+		Body:     msg,
+		AuthorID: authorID,
+	}
+	s.data.Chirps[newChirp.ID] = newChirp
+	return newChirp, nil
+}
+
+func (s *MemStore) DeleteChirp(authorID, chirpID int) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	chirp, ok := s.data.Chirps[chirpID]
+	if !ok {
+		return ErrNotExist
+	}
+	if chirp.IsDeleted() {
+		return ErrDeleted
+	}
+	if chirp.AuthorID != authorID {
+		return ErrNotAuthor
+	}
+	deletedAt := time.Now().UTC()
+	chirp.DeletedAt = &deletedAt
+	s.data.Chirps[chirpID] = chirp
+	return nil
+}
+
+func (s *MemStore) GetChirpByChirpId(chirpID int) (Chirp, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	chirp, ok := s.data.Chirps[chirpID]
+	if !ok {
+		return Chirp{}, ErrNotExist
+	}
+	if chirp.IsDeleted() {
+		return Chirp{}, ErrDeleted
+	}
+	return chirp, nil
+}
+
+func (s *MemStore) GetChirps() []Chirp {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	chirps := []Chirp{}
+	for _, chirp := range s.data.Chirps {
+		if !chirp.IsDeleted() {
+			chirps = append(chirps, chirp)
+		}
+	}
+	sortChirps(chirps)
+	return chirps
+}
+
+func (s *MemStore) GetChirpsByAuthor(authorID int) []Chirp {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	chirps := []Chirp{}
+	for _, chirp := range s.data.Chirps {
+		if !chirp.IsDeleted() && chirp.AuthorID == authorID {
+			chirps = append(chirps, chirp)
+		}
+	}
+	sortChirps(chirps)
+	return chirps
+}
+
+func (s *MemStore) CreateUser(email string, password string) (UserWithoutPW, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return UserWithoutPW{}, err
+	}
+	email = NormalizeEmail(email)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if _, ok := s.userByEmail(email); ok {
+		return UserWithoutPW{}, ErrEmailTaken
+	}
+	newUser := User{
+		ID:       s.nextID(collectionUsers),
+		Password: hashedPassword,
+		Email:    email,
+	}
+	s.data.Users[newUser.ID] = newUser
+	return withoutPassword(newUser), nil
+}
+
+func (s *MemStore) IdentifyUser(email, password string) (UserWithoutPW, bool) {
+	s.mux.RLock()
+	user, ok := s.userByEmail(email)
+	s.mux.RUnlock()
+	if !passwordMatches(user, ok, password) {
+		return UserWithoutPW{}, false
+	}
+	return withoutPassword(user), true
+}
+
+func (s *MemStore) UpdateUser(userID int, email, password string) (UserWithoutPW, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return UserWithoutPW{}, err
+	}
+	email = NormalizeEmail(email)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	user, ok := s.data.Users[userID]
+	if !ok {
+		return UserWithoutPW{}, ErrNotExist
+	}
+	if other, ok := s.userByEmail(email); ok && other.ID != userID {
+		return UserWithoutPW{}, ErrEmailTaken
+	}
+	user.Email = email
+	user.Password = hashedPassword
+	s.data.Users[userID] = user
+	return withoutPassword(user), nil
+}
+
+func (s *MemStore) CreateSession(userID int, refreshToken string, expiresAt time.Time, client SessionClient) (Session, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if _, ok := s.data.Users[userID]; !ok {
+		return Session{}, ErrNotExist
+	}
+	now := time.Now().UTC()
+	session := Session{
+		ID:         s.nextID(collectionSessions),
+		UserID:     userID,
+		TokenHash:  HashRefreshToken(refreshToken),
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  expiresAt.UTC(),
+		UserAgent:  client.UserAgent,
+		IP:         client.IP,
+	}
+	s.data.Sessions[session.ID] = session
+	return session, nil
+}
+
+func (s *MemStore) RotateRefreshToken(refreshToken, newToken string, expiresAt time.Time) (Session, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if session, ok := s.sessionByToken(refreshToken); ok {
+		if session.Expired(time.Now()) {
+			delete(s.data.Sessions, session.ID)
+			return session, ErrRefreshTokenExpired
+		}
+		session = rotateSession(session, newToken, expiresAt)
+		s.data.Sessions[session.ID] = session
+		return session, nil
+	}
+	if refreshToken == "" {
+		return Session{}, ErrNotExist
+	}
+	hash := HashRefreshToken(refreshToken)
+	for id, session := range s.data.Sessions {
+		if slices.Contains(session.RotatedTokenHashes, hash) {
+			delete(s.data.Sessions, id)
+			return session, ErrRefreshTokenReused
+		}
+	}
+	return Session{}, ErrNotExist
+}
+
+func (s *MemStore) RevokeRefreshToken(refreshToken string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	session, ok := s.sessionByToken(refreshToken)
+	if !ok {
+		return ErrNotExist
+	}
+	delete(s.data.Sessions, session.ID)
+	return nil
+}
+
+func (s *MemStore) RevokeAllRefreshTokens(refreshToken string) (int, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	session, ok := s.sessionByToken(refreshToken)
+	if !ok {
+		return 0, ErrNotExist
+	}
+	revoked := 0
+	for id, other := range s.data.Sessions {
+		if other.UserID == session.UserID {
+			delete(s.data.Sessions, id)
+			revoked++
+		}
+	}
+	return revoked, nil
+}
+
+func (s *MemStore) GetSessions(userID int) []Session {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	sessions := []Session{}
+	for _, session := range s.data.Sessions {
+		if session.UserID == userID {
+			sessions = append(sessions, session)
+		}
+	}
+	sortSessions(sessions)
+	return sessions
+}
+
+func (s *MemStore) RevokeSession(userID, sessionID int) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	session, ok := s.data.Sessions[sessionID]
+	if !ok || session.UserID != userID {
+		return ErrNotExist
+	}
+	delete(s.data.Sessions, sessionID)
+	return nil
+}
+
+func (s *MemStore) IsChirpyRed(userID int) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	user, ok := s.data.Users[userID]
+	if !ok {
+		return ErrNotExist
+	}
+	user.IsChirpyRed = true
+	s.data.Users[userID] = user
+	return nil
+}
+
+func (s *MemStore) nextID(collection string) int {
+	s.data.Sequences[collection]++
+	return s.data.Sequences[collection]
+}
+
+func (s *MemStore) userByEmail(email string) (User, bool) {
+	email = NormalizeEmail(email)
+	for _, user := range s.data.Users {
+		if NormalizeEmail(user.Email) == email {
+			return user, true
+		}
+	}
+	return User{}, false
+}
+
+func (s *MemStore) sessionByToken(refreshToken string) (Session, bool) {
+	if refreshToken == "" {
+		return Session{}, false
+	}
+	hash := HashRefreshToken(refreshToken)
+	for _, session := range s.data.Sessions {
+		if session.TokenHash == hash {
+			return session, true
+		}
+	}
+	return Session{}, false
+}
+
+func withoutPassword(user User) UserWithoutPW {
+	return UserWithoutPW{
+		ID:          user.ID,
+		Email:       user.Email,
+		IsChirpyRed: user.IsChirpyRed,
+	}
+}
@@ -0,0 +1,268 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// document is the schema-independent form of DbData that
+// migrations and log replay operate on
+type document map[string]any
+
+// Migration upgrades a document from Version-1 to Version
+type Migration struct {
+	Version     int
+	Description string
+	Apply       func(doc document) error
+}
+
+// collection the refresh tokens were kept in before migration 4
+const legacyCollectionTokens = "tokens"
+
+// migrations is the ordered registry of schema migrations. Append new
+// migrations to the end with the next version number; never edit or
+// reorder released ones.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "store schema version in the database file",
+		Apply: func(doc document) error {
+			doc.collection(collectionChirps)
+			doc.collection(collectionUsers)
+			return nil
+		},
+	},
+	{
+		Version:     2,
+		Description: "add ID sequences and turn deleted chirps into tombstones",
+		Apply: func(doc document) error {
+			deletedAt := time.Now().UTC().Format(time.RFC3339Nano)
+			for key, value := range doc.collection(collectionChirps) {
+				id, err := strconv.Atoi(key)
+				if err != nil {
+					return err
+				}
+				chirp, ok := value.(map[string]any)
+				if !ok {
+					return fmt.Errorf("chirp %s is not an object", key)
+				}
+				// DeleteChirp used to overwrite chirps with an empty Chirp{}
+				if intValue(chirp["id"]) == 0 {
+					chirp["id"] = json.Number(key)
+					chirp["deleted_at"] = deletedAt
+				}
+				doc.bumpSequence(collectionChirps, id)
+			}
+			for key := range doc.collection(collectionUsers) {
+				id, err := strconv.Atoi(key)
+				if err != nil {
+					return err
+				}
+				doc.bumpSequence(collectionUsers, id)
+			}
+			return nil
+		},
+	},
+	{
+		Version:     3,
+		Description: "move refresh tokens from users into their own collection",
+		Apply: func(doc document) error {
+			users := doc.collection(collectionUsers)
+			tokens := doc.collection(legacyCollectionTokens)
+			createdAt := time.Now().UTC().Format(time.RFC3339Nano)
+			// in user order, so the token IDs do not depend on map order
+			ids := make([]int, 0, len(users))
+			for key := range users {
+				id, err := strconv.Atoi(key)
+				if err != nil {
+					return err
+				}
+				ids = append(ids, id)
+			}
+			sort.Ints(ids)
+			for _, userID := range ids {
+				user, ok := users[strconv.Itoa(userID)].(map[string]any)
+				if !ok {
+					return fmt.Errorf("user %d is not an object", userID)
+				}
+				token, _ := user["refresh_token"].(string)
+				delete(user, "refresh_token")
+				if token == "" {
+					continue
+				}
+				id := intValue(doc.collection(sequencesKey)[legacyCollectionTokens]) + 1
+				tokens[strconv.Itoa(id)] = map[string]any{
+					"id":         json.Number(strconv.Itoa(id)),
+					"user_id":    json.Number(strconv.Itoa(userID)),
+					"token":      token,
+					"created_at": createdAt,
+				}
+				doc.bumpSequence(legacyCollectionTokens, id)
+			}
+			return nil
+		},
+	},
+	{
+		Version:     4,
+		Description: "turn refresh tokens into sessions that store a hash of the token",
+		Apply: func(doc document) error {
+			sessions := doc.collection(collectionSessions)
+			for key, value := range doc.collection(legacyCollectionTokens) {
+				session, ok := value.(map[string]any)
+				if !ok {
+					return fmt.Errorf("refresh token %s is not an object", key)
+				}
+				token, _ := session["token"].(string)
+				delete(session, "token")
+				session["token_hash"] = HashRefreshToken(token)
+				session["last_used_at"] = session["created_at"]
+				sessions[key] = session
+			}
+			delete(doc, legacyCollectionTokens)
+			sequences := doc.collection(sequencesKey)
+			if seq, ok := sequences[legacyCollectionTokens]; ok {
+				sequences[collectionSessions] = seq
+				delete(sequences, legacyCollectionTokens)
+			}
+			return nil
+		},
+	},
+	{
+		Version:     5,
+		Description: "expire the refresh tokens of sessions DefaultRefreshTokenTTL after their last use",
+		Apply: func(doc document) error {
+			for key, value := range doc.collection(collectionSessions) {
+				session, ok := value.(map[string]any)
+				if !ok {
+					return fmt.Errorf("session %s is not an object", key)
+				}
+				lastUsed, _ := session["last_used_at"].(string)
+				lastUsedAt, err := time.Parse(time.RFC3339Nano, lastUsed)
+				if err != nil {
+					return fmt.Errorf("session %s: %w", key, err)
+				}
+				session["expires_at"] = lastUsedAt.Add(DefaultRefreshTokenTTL).Format(time.RFC3339Nano)
+			}
+			return nil
+		},
+	},
+}
+
+// schema version of newly written snapshots
+func currentVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// return the named collection, creating it if it is missing
+func (doc document) collection(name string) map[string]any {
+	c, ok := doc[name].(map[string]any)
+	if !ok {
+		c = make(map[string]any)
+		doc[name] = c
+	}
+	return c
+}
+
+// raise the collection's sequence to at least id
+func (doc document) bumpSequence(collection string, id int) {
+	sequences := doc.collection(sequencesKey)
+	if intValue(sequences[collection]) < id {
+		sequences[collection] = json.Number(strconv.Itoa(id))
+	}
+}
+
+func intValue(value any) int {
+	switch n := value.(type) {
+	case json.Number:
+		i, _ := n.Int64()
+		return int(i)
+	case float64:
+		return int(n)
+	}
+	return 0
+}
+
+// decode JSON keeping numbers as json.Number so IDs survive the round trip
+func decodeValue(raw []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func decodeDocument(raw []byte) (document, error) {
+	value, err := decodeValue(raw)
+	if err != nil {
+		return nil, err
+	}
+	doc, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("database file holds %T, not an object", value)
+	}
+	return doc, nil
+}
+
+func documentToData(doc document) (*DbData, error) {
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	data := newDbData()
+	if err := json.Unmarshal(raw, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// migrations that upgrade a document stored at version
+func pendingMigrations(version int) ([]Migration, error) {
+	if version > currentVersion() {
+		return nil, fmt.Errorf("database schema version %d is newer than supported version %d", version, currentVersion())
+	}
+	pending := []Migration{}
+	for _, m := range migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// run the pending migrations on doc in order
+func migrate(doc document, version int) ([]Migration, error) {
+	pending, err := pendingMigrations(version)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range pending {
+		if err := m.Apply(doc); err != nil {
+			return nil, fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Description, err)
+		}
+	}
+	return pending, nil
+}
+
+// PendingMigrations reports the migrations NewDBWithOptions would run
+// on the database file at path, without modifying it
+func PendingMigrations(path string, opts Options) ([]Migration, error) {
+	keys, err := optionsKeyring(opts)
+	if err != nil {
+		return nil, err
+	}
+	fsys := opts.FS
+	if fsys == nil {
+		fsys = OSFS{}
+	}
+	stored, err := readStoredWithFallback(fsys, path, defaultBackups, keys)
+	if err != nil {
+		return nil, err
+	}
+	return pendingMigrations(stored.manifest.Version)
+}
@@ -0,0 +1,201 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+var ErrChangeGap = errors.New("changes do not continue the database")
+
+// ChangeSeq returns the seq of the last change committed, which is
+// where a replica of this database resumes the primary's feed
+func (db *DB) ChangeSeq() int64 {
+	seq := int64(0)
+	db.View(func(tx *Tx) error {
+		seq = tx.db.data.ChangeSeq
+		return nil
+	})
+	return seq
+}
+
+// Restore replaces the whole database with a backup written by Backup,
+// in memory and on disk, and continues the change feed after the
+// backup's change_seq. Transactions committed before Restore are lost.
+// Once the database has an encryption key, it only restores encrypted
+// backups.
+func (db *DB) Restore(r io.Reader) error {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	snapshot, err := decodeSnapshot(raw, db.keys)
+	if err != nil {
+		return err
+	}
+	if snapshot.Layout != layoutSingle {
+		return fmt.Errorf("not a backup: holds a %s", snapshot.Layout)
+	}
+	data, _, _, err := loadSnapshot(storedDB{manifest: snapshot}, func(func(logRecord) error) (int, error) {
+		return 0, nil
+	})
+	if err != nil {
+		return err
+	}
+	unlock := db.quiesce()
+	defer unlock()
+	if db.writeErr != nil {
+		return db.writeErr
+	}
+	req := &commitRequest{run: func() error { return db.restore(data) }, done: make(chan error, 1)}
+	if err := db.commits.push(req); err != nil {
+		return err
+	}
+	return <-req.done
+}
+
+// replace DB.data with data on disk and in memory. Run by the
+// committer, which owns the log, while Restore holds every lock.
+func (db *DB) restore(data *DbData) error {
+	if err := db.checkUnmodified(); err != nil {
+		return err
+	}
+	// the retained changes belong to the history that ends here
+	if err := removeRetainedChanges(db.fsys, db.path); err != nil {
+		return err
+	}
+	// empty the log first: should the new snapshot not make it to
+	// disk, the old one is consistent on its own
+	if err := db.truncateLog(); err != nil {
+		return err
+	}
+	db.data = data
+	db.index = buildIndexes(data)
+	if err := db.writeDBtoDisk(); err != nil {
+		if _, loadErr := db.loadDB(); loadErr != nil {
+			log.Printf("database: cannot reload after failed restore: %v", loadErr)
+			db.writeErr = loadErr
+		}
+		db.commits.resetSeq(db.data.ChangeSeq)
+		return err
+	}
+	db.commits.resetSeq(data.ChangeSeq)
+	db.feed.reset(data.ChangeSeq)
+	return nil
+}
+
+// ApplyChanges commits changes read from another database's feed under
+// their own seqs, so that this database follows that one. They have to
+// continue this database's ChangeSeq without gaps.
+func (db *DB) ApplyChanges(changes []Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	records := make([]logRecord, 0, len(changes))
+	applies := make([]func(), 0, len(changes))
+	for _, change := range changes {
+		record, apply, err := db.changeRecord(change)
+		if err != nil {
+			return fmt.Errorf("change %d: %w", change.Seq, err)
+		}
+		records = append(records, record)
+		applies = append(applies, apply)
+	}
+
+	unlock := db.lockAll()
+	if db.writeErr != nil {
+		unlock()
+		return db.writeErr
+	}
+	for i, record := range records {
+		if want := db.data.ChangeSeq + int64(i) + 1; record.Seq != want {
+			unlock()
+			return fmt.Errorf("%w: expected change %d, got %d", ErrChangeGap, want, record.Seq)
+		}
+	}
+	req := &commitRequest{records: records, done: make(chan error, 1)}
+	if err := db.commits.push(req); err != nil {
+		unlock()
+		return err
+	}
+	for _, apply := range applies {
+		apply()
+	}
+	db.locks.markApplied(collections, req.number)
+	db.raiseChangeSeq(records)
+	unlock()
+	return <-req.done
+}
+
+// the log record of change and the function applying it to DB.data,
+// to be called with every lock held
+func (db *DB) changeRecord(change Change) (logRecord, func(), error) {
+	record := logRecord{
+		Op:         opPut,
+		Collection: change.Collection,
+		ID:         change.ID,
+		Value:      change.Value,
+		Seq:        change.Seq,
+		Created:    change.Type == ChangeCreated,
+	}
+	if change.Seq <= 0 {
+		return logRecord{}, nil, fmt.Errorf("invalid seq %d", change.Seq)
+	}
+	switch change.Type {
+	case ChangeCreated, ChangeUpdated:
+	case ChangeDeleted:
+		record.Op = opDelete
+		record.Value = nil
+		var apply func()
+		switch change.Collection {
+		case collectionUsers:
+			apply = func() { db.deleteUser(change.ID) }
+		case collectionChirps:
+			apply = func() { db.deleteChirp(change.ID) }
+		case collectionSessions:
+			apply = func() { db.deleteSession(change.ID) }
+		default:
+			return logRecord{}, nil, fmt.Errorf("unknown collection %q", change.Collection)
+		}
+		return record, apply, nil
+	default:
+		return logRecord{}, nil, fmt.Errorf("unknown change type %q", change.Type)
+	}
+
+	var apply func()
+	switch change.Collection {
+	case collectionUsers:
+		user := User{}
+		if err := json.Unmarshal(change.Value, &user); err != nil {
+			return logRecord{}, nil, err
+		}
+		apply = func() { db.putUser(user) }
+	case collectionChirps:
+		chirp := Chirp{}
+		if err := json.Unmarshal(change.Value, &chirp); err != nil {
+			return logRecord{}, nil, err
+		}
+		apply = func() { db.putChirp(chirp) }
+	case collectionSessions:
+		session := Session{}
+		if err := json.Unmarshal(change.Value, &session); err != nil {
+			return logRecord{}, nil, err
+		}
+		apply = func() { db.putSession(session) }
+	default:
+		return logRecord{}, nil, fmt.Errorf("unknown collection %q", change.Collection)
+	}
+	return record, func() {
+		apply()
+		db.raiseSequence(change.Collection, change.ID)
+	}, nil
+}
+
+// raise the collection's sequence to at least id, as log replay does
+func (db *DB) raiseSequence(collection string, id int) {
+	db.seqMux.Lock()
+	defer db.seqMux.Unlock()
+	db.data.Sequences[collection] = max(db.data.Sequences[collection], id)
+}
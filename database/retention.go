@@ -0,0 +1,141 @@
+package database
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	defaultRetentionInterval = time.Hour
+	defaultChirpTombstoneAge = 30 * 24 * time.Hour
+)
+
+// RetentionPolicy says how long data nobody reads any more is kept
+type RetentionPolicy struct {
+	// age of a chirp tombstone at which the chirp is purged for good,
+	// defaults to defaultChirpTombstoneAge. Negative keeps tombstones.
+	ChirpTombstones time.Duration
+	// time since a session was last used at which it is closed,
+	// logging its device out. Zero or negative keeps sessions open
+	// until revoked.
+	IdleSessions time.Duration
+}
+
+// RetentionReport lists what one retention run removed
+type RetentionReport struct {
+	Chirps   []int `json:"chirps"`
+	Sessions []int `json:"sessions"`
+}
+
+func (report RetentionReport) String() string {
+	return fmt.Sprintf("%d chirp tombstones, %d expired or idle sessions", len(report.Chirps), len(report.Sessions))
+}
+
+// retentionSchedule applies the retention policy every interval
+type retentionSchedule struct {
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newRetentionSchedule(opts Options) *retentionSchedule {
+	if opts.RetentionInterval < 0 {
+		return nil
+	}
+	schedule := &retentionSchedule{
+		interval: opts.RetentionInterval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if schedule.interval == 0 {
+		schedule.interval = defaultRetentionInterval
+	}
+	return schedule
+}
+
+// ApplyRetention removes the expired sessions and the chirp tombstones
+// and idle sessions the retention policy no longer keeps at now, and
+// logs them. Every removal is committed as a deletion, so replicas and
+// other change feed consumers see it.
+func (db *DB) ApplyRetention(now time.Time) (RetentionReport, error) {
+	report := RetentionReport{Chirps: []int{}, Sessions: []int{}}
+	if age := db.retention.ChirpTombstones; age > 0 {
+		err := db.update([]string{collectionChirps}, func(tx *Tx) error {
+			for _, id := range sortedKeys(tx.db.data.Chirps) {
+				chirp, _ := tx.Chirp(id)
+				if !chirp.IsDeleted() || now.Sub(*chirp.DeletedAt) < age {
+					continue
+				}
+				if err := tx.DeleteChirp(chirp.ID); err != nil {
+					return err
+				}
+				report.Chirps = append(report.Chirps, chirp.ID)
+			}
+			return nil
+		})
+		if err != nil {
+			return RetentionReport{}, err
+		}
+	}
+	// expired sessions are of no use to anyone, idle ones only go if
+	// the policy says so
+	idle := db.retention.IdleSessions
+	err := db.update([]string{collectionSessions}, func(tx *Tx) error {
+		for _, session := range tx.Sessions() {
+			if !session.Expired(now) && (idle <= 0 || now.Sub(session.LastUsedAt) < idle) {
+				continue
+			}
+			if err := tx.DeleteSession(session.ID); err != nil {
+				return err
+			}
+			report.Sessions = append(report.Sessions, session.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		// the chirps are gone, the sessions are not
+		report.Sessions = []int{}
+		logRetention(report)
+		return report, err
+	}
+	logRetention(report)
+	return report, nil
+}
+
+// runRetention applies the retention policy every interval until Close
+func (db *DB) runRetention() {
+	defer close(db.retentionSchedule.done)
+	ticker := time.NewTicker(db.retentionSchedule.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.retentionSchedule.stop:
+			return
+		case now := <-ticker.C:
+			if _, err := db.ApplyRetention(now); err != nil {
+				log.Printf("database: scheduled retention failed: %v", err)
+			}
+		}
+	}
+}
+
+func logRetention(report RetentionReport) {
+	if len(report.Chirps) == 0 && len(report.Sessions) == 0 {
+		return
+	}
+	log.Printf("database: retention removed %s: chirps %v, sessions %v", report, report.Chirps, report.Sessions)
+}
+
+// stop the retention scheduler and wait for a running pass to finish
+func (db *DB) stopRetention() {
+	if db.retentionSchedule == nil {
+		return
+	}
+	select {
+	case <-db.retentionSchedule.stop:
+	default:
+		close(db.retentionSchedule.stop)
+	}
+	<-db.retentionSchedule.done
+}
@@ -0,0 +1,151 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+var ErrRefreshTokenReused = errors.New("refresh token was already rotated")
+
+var ErrRefreshTokenExpired = errors.New("refresh token has expired")
+
+// most rotated token hashes a session remembers to detect reuse
+const maxRotatedTokens = 100
+
+// DefaultRefreshTokenTTL is how long refresh tokens last unless
+// configured otherwise
+const DefaultRefreshTokenTTL = 60 * 24 * time.Hour
+
+// SessionClient describes the device a session was opened from
+type SessionClient struct {
+	UserAgent string
+	IP        string
+}
+
+// CreateSession logs the user in on one more device with a refresh
+// token that expires at expiresAt. The user's other sessions stay
+// open.
+func (db *DB) CreateSession(userID int, refreshToken string, expiresAt time.Time, client SessionClient) (Session, error) {
+	session := Session{}
+	err := db.update([]string{collectionUsers, collectionSessions}, func(tx *Tx) error {
+		if _, ok := tx.User(userID); !ok {
+			return ErrNotExist
+		}
+		now := time.Now().UTC()
+		var err error
+		session, err = tx.InsertSession(Session{
+			UserID:     userID,
+			TokenHash:  HashRefreshToken(refreshToken),
+			CreatedAt:  now,
+			LastUsedAt: now,
+			ExpiresAt:  expiresAt.UTC(),
+			UserAgent:  client.UserAgent,
+			IP:         client.IP,
+		})
+		return err
+	})
+	return session, err
+}
+
+// RotateRefreshToken replaces refreshToken with newToken, which
+// expires at expiresAt, in its session and returns the session. A token
+// that was already replaced may have been stolen: its whole session is
+// closed and returned with ErrRefreshTokenReused. An expired token
+// closes its session with ErrRefreshTokenExpired, unknown tokens give
+// ErrNotExist.
+func (db *DB) RotateRefreshToken(refreshToken, newToken string, expiresAt time.Time) (Session, error) {
+	session := Session{}
+	var closed error
+	err := db.update([]string{collectionSessions}, func(tx *Tx) error {
+		var ok bool
+		session, ok = tx.SessionByToken(refreshToken)
+		if ok {
+			if session.Expired(time.Now()) {
+				closed = ErrRefreshTokenExpired
+				return tx.DeleteSession(session.ID)
+			}
+			session = rotateSession(session, newToken, expiresAt)
+			return tx.PutSession(session)
+		}
+		session, ok = tx.SessionByRotatedToken(refreshToken)
+		if !ok {
+			return ErrNotExist
+		}
+		closed = ErrRefreshTokenReused
+		return tx.DeleteSession(session.ID)
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	return session, closed
+}
+
+// session after a refresh replaced its token with newToken
+func rotateSession(session Session, newToken string, expiresAt time.Time) Session {
+	// clipped, the stored session must not share the new hash
+	rotated := append(slices.Clip(session.RotatedTokenHashes), session.TokenHash)
+	session.RotatedTokenHashes = rotated[max(0, len(rotated)-maxRotatedTokens):]
+	session.TokenHash = HashRefreshToken(newToken)
+	session.LastUsedAt = time.Now().UTC()
+	session.ExpiresAt = expiresAt.UTC()
+	return session
+}
+
+// RevokeRefreshToken closes the session refreshToken belongs to, or
+// returns ErrNotExist if there is none
+func (db *DB) RevokeRefreshToken(refreshToken string) error {
+	return db.update([]string{collectionSessions}, func(tx *Tx) error {
+		session, ok := tx.SessionByToken(refreshToken)
+		if !ok {
+			return ErrNotExist
+		}
+		return tx.DeleteSession(session.ID)
+	})
+}
+
+// RevokeAllRefreshTokens closes every session of the user refreshToken
+// belongs to, logging them out everywhere, and returns how many. It
+// returns ErrNotExist if refreshToken belongs to no session.
+func (db *DB) RevokeAllRefreshTokens(refreshToken string) (int, error) {
+	revoked := 0
+	err := db.update([]string{collectionSessions}, func(tx *Tx) error {
+		session, ok := tx.SessionByToken(refreshToken)
+		if !ok {
+			return ErrNotExist
+		}
+		for _, session := range tx.SessionsByUser(session.UserID) {
+			if err := tx.DeleteSession(session.ID); err != nil {
+				return err
+			}
+			revoked++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return revoked, nil
+}
+
+// GetSessions returns the open sessions of one user ordered by ID
+func (db *DB) GetSessions(userID int) []Session {
+	sessions := []Session{}
+	db.view([]string{collectionSessions}, func(tx *Tx) error {
+		sessions = tx.SessionsByUser(userID)
+		return nil
+	})
+	return sessions
+}
+
+// RevokeSession closes one session of a user, ErrNotExist if the user
+// has no session with that ID
+func (db *DB) RevokeSession(userID, sessionID int) error {
+	return db.update([]string{collectionSessions}, func(tx *Tx) error {
+		session, ok := tx.Session(sessionID)
+		if !ok || session.UserID != userID {
+			return ErrNotExist
+		}
+		return tx.DeleteSession(sessionID)
+	})
+}
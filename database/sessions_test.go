@@ -0,0 +1,45 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRevokeReturnsStorageErrors(t *testing.T) {
+	fsys := NewFaultFS(NewMemFS())
+	db := openTestDB(t, fsys, Options{})
+	user, err := db.CreateUser("user@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Hour)
+	if _, err := db.CreateSession(user.ID, "token", expires, SessionClient{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.RevokeRefreshToken("unknown"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("RevokeRefreshToken(unknown) = %v, want ErrNotExist", err)
+	}
+	if _, err := db.RevokeAllRefreshTokens("unknown"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("RevokeAllRefreshTokens(unknown) = %v, want ErrNotExist", err)
+	}
+
+	fsys.SetInjector(FailAll(OpSync, nil))
+	if err := db.RevokeRefreshToken("token"); !errors.Is(err, ErrInjected) {
+		t.Errorf("RevokeRefreshToken = %v, want the injected fault", err)
+	}
+	if _, err := db.RevokeAllRefreshTokens("token"); !errors.Is(err, ErrInjected) {
+		t.Errorf("RevokeAllRefreshTokens = %v, want the injected fault", err)
+	}
+	fsys.SetInjector(nil)
+
+	// the failed revokes left the session open
+	if sessions := db.GetSessions(user.ID); len(sessions) != 1 {
+		t.Fatalf("%d sessions, want 1", len(sessions))
+	}
+	revoked, err := db.RevokeAllRefreshTokens("token")
+	if err != nil || revoked != 1 {
+		t.Errorf("RevokeAllRefreshTokens = %d, %v, want 1 session", revoked, err)
+	}
+}
@@ -0,0 +1,309 @@
+package database
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+var ErrChecksumMismatch = errors.New("snapshot checksum mismatch")
+
+// SnapshotFormat is the encoding of the database file
+type SnapshotFormat string
+
+const (
+	// FormatJSON is indented JSON, readable and editable by hand
+	FormatJSON SnapshotFormat = "json"
+	// FormatBinary is the compact JSON data in a gob envelope behind
+	// binaryMagic, smaller than the indented FormatJSON
+	FormatBinary SnapshotFormat = "binary"
+)
+
+// first bytes of a binary snapshot, JSON files start with '{'
+var binaryMagic = []byte("CHIRPYGOB2\n")
+
+// first bytes of the binary snapshots written before binaryMagic,
+// whose data is gob encoded Go values, see gob.go
+var gobValuesMagic = []byte("CHIRPYGOB1\n")
+
+// what a snapshot file holds
+const (
+	// all of DbData in one file, as written before collections got
+	// their own files and by Backup
+	layoutSingle = ""
+	// the manifest at the database path
+	layoutManifest = "manifest"
+	// one collection of a generation
+	layoutCollection = "collection"
+	// the change feed's retained changes, see changesPath
+	layoutChanges = "changes"
+)
+
+// snapshotFile is the on-disk layout of the database file
+type snapshotFile struct {
+	Version int    `json:"version"`
+	Layout  string `json:"layout,omitempty"`
+	// name of the collection of a layoutCollection file
+	Collection string `json:"collection,omitempty"`
+	Checksum   string `json:"checksum"`
+	// compact data, of binary snapshots too
+	Data json.RawMessage `json:"data"`
+	// ID of the key the file was encrypted with, "" if it was not
+	keyID  string
+	format SnapshotFormat
+	// the data was gob encoded Go values, so the file is rewritten in
+	// the current binary layout
+	gobValues bool
+}
+
+// binarySnapshot is the gob encoded layout of a binary database file.
+// BinaryData holds the compact JSON data, which keeps binary files as
+// independent of the Go types as JSON ones. The checksum covers
+// BinaryData.
+type binarySnapshot struct {
+	Version    int
+	Layout     string
+	Collection string
+	Checksum   string
+	BinaryData []byte
+}
+
+// ParseSnapshotFormat validates a format name, "" is FormatJSON
+func ParseSnapshotFormat(name string) (SnapshotFormat, error) {
+	switch SnapshotFormat(name) {
+	case "", FormatJSON:
+		return FormatJSON, nil
+	case FormatBinary:
+		return FormatBinary, nil
+	}
+	return "", fmt.Errorf("unknown database format %q", name)
+}
+
+func backupPath(path string, generation int) string {
+	return fmt.Sprintf("%s.%d", path, generation)
+}
+
+// checksum of the compact JSON encoding of data
+func checksum(compactData []byte) string {
+	sum := sha256.Sum256(compactData)
+	return hex.EncodeToString(sum[:])
+}
+
+// encode data as a checksummed snapshot of the current schema
+// version, encrypted if the keyring has a current key
+func encodeSnapshot(data *DbData, format SnapshotFormat, keys *keyring) ([]byte, error) {
+	return encodeSnapshotFile(snapshotFile{Layout: layoutSingle}, data, format, keys)
+}
+
+// encode value into the file described by header, which sets the
+// layout and collection
+func encodeSnapshotFile(header snapshotFile, value any, format SnapshotFormat, keys *keyring) ([]byte, error) {
+	var snapshot []byte
+	var err error
+	header.Version = currentVersion()
+	if format == FormatBinary {
+		snapshot, err = encodeBinarySnapshot(header, value)
+	} else {
+		snapshot, err = encodeJSONSnapshot(header, value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return keys.seal(snapshot, purposeSnapshot)
+}
+
+func encodeJSONSnapshot(header snapshotFile, value any) ([]byte, error) {
+	compactData, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	header.Checksum = checksum(compactData)
+	header.Data = compactData
+	return json.MarshalIndent(header, "", " ")
+}
+
+func encodeBinarySnapshot(header snapshotFile, value any) ([]byte, error) {
+	compactData, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.Write(binaryMagic)
+	err = gob.NewEncoder(&buf).Encode(binarySnapshot{
+		Version:    header.Version,
+		Layout:     header.Layout,
+		Collection: header.Collection,
+		Checksum:   checksum(compactData),
+		BinaryData: compactData,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decrypt and decode a snapshot in either format, verifying its
+// checksum. Files written before snapshots were checksummed hold the
+// bare data at version 0.
+func decodeSnapshot(raw []byte, keys *keyring) (snapshotFile, error) {
+	raw, keyID, err := keys.open(raw, purposeSnapshot)
+	if err != nil {
+		return snapshotFile{}, err
+	}
+	if bytes.HasPrefix(raw, binaryMagic) {
+		return decodeBinarySnapshot(raw[len(binaryMagic):], keyID)
+	}
+	if bytes.HasPrefix(raw, gobValuesMagic) {
+		return decodeGobValuesSnapshot(raw[len(gobValuesMagic):], keyID)
+	}
+	file := snapshotFile{keyID: keyID, format: FormatJSON}
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return snapshotFile{}, err
+	}
+	if file.Data == nil {
+		return snapshotFile{Data: raw, keyID: keyID, format: FormatJSON}, nil
+	}
+	var compactData bytes.Buffer
+	if err := json.Compact(&compactData, file.Data); err != nil {
+		return snapshotFile{}, err
+	}
+	if checksum(compactData.Bytes()) != file.Checksum {
+		return snapshotFile{}, ErrChecksumMismatch
+	}
+	file.Data = compactData.Bytes()
+	return file, nil
+}
+
+func decodeBinarySnapshot(raw []byte, keyID string) (snapshotFile, error) {
+	binary, err := decodeBinaryEnvelope(raw)
+	if err != nil {
+		return snapshotFile{}, err
+	}
+	return snapshotFile{
+		Version:    binary.Version,
+		Layout:     binary.Layout,
+		Collection: binary.Collection,
+		Checksum:   binary.Checksum,
+		Data:       binary.BinaryData,
+		keyID:      keyID,
+		format:     FormatBinary,
+	}, nil
+}
+
+// decode the gob envelope of a binary snapshot, verifying its checksum
+func decodeBinaryEnvelope(raw []byte) (binarySnapshot, error) {
+	binary := binarySnapshot{}
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&binary); err != nil {
+		return binarySnapshot{}, err
+	}
+	if checksum(binary.BinaryData) != binary.Checksum {
+		return binarySnapshot{}, ErrChecksumMismatch
+	}
+	return binary, nil
+}
+
+// decode the snapshot's data into v. Only valid at the current schema
+// version, older snapshots must go through document and migrate.
+func (file snapshotFile) decode(v any) error {
+	return json.Unmarshal(file.Data, v)
+}
+
+// decode the data of a single-file snapshot
+func (file snapshotFile) decodeData() (*DbData, error) {
+	data := newDbData()
+	if err := file.decode(data); err != nil {
+		return nil, err
+	}
+	data.fillMaps()
+	return data, nil
+}
+
+// the snapshot's data in the schema-independent form migrations use
+func (file snapshotFile) document() (document, error) {
+	return decodeDocument(file.Data)
+}
+
+// write data to path atomically: the new content is written to a temp
+// file in the same directory, fsynced, and renamed over path. The
+// previous generations are kept as path.1 ... path.<backups>.
+func writeFileAtomic(fsys FS, path string, data []byte, backups int) (err error) {
+	dir := filepath.Dir(path)
+	// CreateTemp creates the file with mode 0600
+	tmp, err := fsys.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			fsys.Remove(tmp.Name())
+		}
+	}()
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = rotateBackups(fsys, path, backups); err != nil {
+		return err
+	}
+	if err = fsys.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return fsys.SyncDir(dir)
+}
+
+// shift path.1 ... path.<backups-1> up one generation and
+// hard link the current file as path.1
+func rotateBackups(fsys FS, path string, backups int) error {
+	if backups <= 0 {
+		return nil
+	}
+	if _, err := fsys.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	for generation := backups - 1; generation >= 1; generation-- {
+		err := fsys.Rename(backupPath(path, generation), backupPath(path, generation+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := fsys.Remove(backupPath(path, 1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return fsys.Link(path, backupPath(path, 1))
+}
+
+// delete all backup generations of path
+func removeBackups(fsys FS, path string, backups int) error {
+	for generation := 1; generation <= backups; generation++ {
+		err := fsys.Remove(backupPath(path, generation))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func readSnapshot(fsys FS, path string, keys *keyring) (snapshotFile, error) {
+	raw, err := fsys.ReadFile(path)
+	if err != nil {
+		return snapshotFile{}, err
+	}
+	snapshot, err := decodeSnapshot(raw, keys)
+	if err != nil {
+		return snapshotFile{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return snapshot, nil
+}
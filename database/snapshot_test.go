@@ -0,0 +1,118 @@
+package database
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// copy the database files of testdata/name into /data of a new MemFS.
+// The binary-vN directories hold binary databases at schema version N,
+// written by the code of that version: one user, logged in with the
+// refresh token "refresh-token" and upgraded to Chirpy Red, who wrote
+// the chirps "kept" and "deleted", of which the second is deleted.
+// The refresh token of binary-v5 replaced "old-token" on rotation and
+// expires at the start of 2100.
+func testdataFS(t *testing.T, name string) *MemFS {
+	t.Helper()
+	fsys := NewMemFS()
+	if err := fsys.MkdirAll("/data", 0700); err != nil {
+		t.Fatal(err)
+	}
+	paths, err := filepath.Glob(filepath.Join("testdata", name, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := fsys.OpenFile("/data/"+filepath.Base(path), os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(raw); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	return fsys
+}
+
+// check the user and chirps every testdata database holds
+func checkTestdataDB(t *testing.T, db *DB) {
+	t.Helper()
+	user, ok := db.IdentifyUser("user@example.com", "password")
+	if !ok || !user.IsChirpyRed {
+		t.Errorf("IdentifyUser = %+v, %v, want the Chirpy Red user", user, ok)
+	}
+	chirps := map[string]Chirp{}
+	for _, chirp := range db.data.Chirps {
+		chirps[chirp.Body] = chirp
+	}
+	if kept, ok := chirps["kept"]; !ok || kept.IsDeleted() || kept.AuthorID != user.ID {
+		t.Errorf("chirp kept = %+v", kept)
+	}
+	if deleted, ok := chirps["deleted"]; !ok || !deleted.IsDeleted() {
+		t.Errorf("chirp deleted = %+v", deleted)
+	}
+	// still logged in
+	sessions := db.GetSessions(user.ID)
+	if len(sessions) != 1 || sessions[0].TokenHash != HashRefreshToken("refresh-token") {
+		t.Errorf("sessions = %+v, want the one of the refresh token", sessions)
+	}
+	if problems, err := db.Check(); err != nil || len(problems) > 0 {
+		t.Errorf("Check = %v, %v", problems, err)
+	}
+}
+
+func TestOpenOldBinarySnapshots(t *testing.T) {
+	for _, name := range []string{"binary-v2", "binary-v3", "binary-v4", "binary-v5"} {
+		t.Run(name, func(t *testing.T) {
+			fsys := testdataFS(t, name)
+			// no retention runs, the fixtures' sessions expire
+			opts := Options{Format: FormatBinary, RetentionInterval: -1}
+			db := openTestDB(t, fsys, opts)
+			checkTestdataDB(t, db)
+			if name == "binary-v5" {
+				session := db.GetSessions(1)[0]
+				expires := time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+				if !session.ExpiresAt.Equal(expires) || len(session.RotatedTokenHashes) != 1 ||
+					session.RotatedTokenHashes[0] != HashRefreshToken("old-token") {
+					t.Errorf("session = %+v, want the rotation and expiry kept", session)
+				}
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// rewritten with the data as JSON, which opens without
+			// migrating or converting
+			raw, err := fsys.ReadFile("/data/database.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(raw, binaryMagic) {
+				t.Errorf("database file starts with %q, want %q", raw[:len(binaryMagic)], binaryMagic)
+			}
+			keys, err := newKeyring(nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored, err := readStored(fsys, "/data/database.json", "/data/database.json", keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.manifest.Version != currentVersion() {
+				t.Errorf("rewritten at version %d, want %d", stored.manifest.Version, currentVersion())
+			}
+			if _, reformat := stored.differs("", FormatBinary); reformat {
+				t.Error("rewritten database still needs converting")
+			}
+			checkTestdataDB(t, openTestDB(t, fsys, opts))
+		})
+	}
+}
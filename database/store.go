@@ -0,0 +1,49 @@
+package database
+
+import "time"
+
+// ChirpStore stores chirps
+type ChirpStore interface {
+	CreateChirp(msg string, authorID int) (Chirp, error)
+	DeleteChirp(authorID, chirpID int) error
+	GetChirpByChirpId(chirpID int) (Chirp, error)
+	GetChirps() []Chirp
+	GetChirpsByAuthor(authorID int) []Chirp
+}
+
+// UserStore stores users and their credentials
+type UserStore interface {
+	CreateUser(email string, password string) (UserWithoutPW, error)
+	IdentifyUser(email, password string) (UserWithoutPW, bool)
+	UpdateUser(userID int, email, password string) (UserWithoutPW, error)
+}
+
+// SessionStore stores the sessions users log in with, each used with
+// its own refresh token
+type SessionStore interface {
+	CreateSession(userID int, refreshToken string, expiresAt time.Time, client SessionClient) (Session, error)
+	RotateRefreshToken(refreshToken, newToken string, expiresAt time.Time) (Session, error)
+	RevokeRefreshToken(refreshToken string) error
+	RevokeAllRefreshTokens(refreshToken string) (int, error)
+	GetSessions(userID int) []Session
+	RevokeSession(userID, sessionID int) error
+}
+
+// MembershipStore stores paid memberships
+type MembershipStore interface {
+	IsChirpyRed(userID int) error
+}
+
+// Store is everything the HTTP handlers need from a storage backend.
+// DB keeps the data in a file on disk, MemStore only in memory.
+type Store interface {
+	ChirpStore
+	UserStore
+	SessionStore
+	MembershipStore
+}
+
+var (
+	_ Store = (*DB)(nil)
+	_ Store = (*MemStore)(nil)
+)
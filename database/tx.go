@@ -0,0 +1,572 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+)
+
+var ErrTxReadOnly = errors.New("cannot write in a read-only transaction")
+
+// Tx is a view of the database handed to View and Update. Writes are
+// staged in the Tx and only reach DB.data once fn has succeeded, so a
+// failed transaction leaves memory and disk untouched.
+// A Tx only sees the collections it locked and panics when used on
+// any other. It must not be used after its function returns, and that
+// function must not start another transaction itself.
+type Tx struct {
+	db        *DB
+	writable  bool
+	scope     map[string]struct{}
+	users     staged[User]
+	chirps    staged[Chirp]
+	sessions  staged[Session]
+	sequences map[string]int
+}
+
+// staged holds the changes of a Tx to one collection
+type staged[V any] struct {
+	puts    map[int]V
+	deleted map[int]struct{}
+}
+
+func newStaged[V any]() staged[V] {
+	return staged[V]{puts: make(map[int]V), deleted: make(map[int]struct{})}
+}
+
+// look id up in the staged changes first, then in stored
+func (s staged[V]) get(stored map[int]V, id int) (V, bool) {
+	if value, ok := s.puts[id]; ok {
+		return value, true
+	}
+	if _, ok := s.deleted[id]; ok {
+		var zero V
+		return zero, false
+	}
+	value, ok := stored[id]
+	return value, ok
+}
+
+// whether the transaction replaced or deleted the stored value
+func (s staged[V]) touched(id int) bool {
+	_, put := s.puts[id]
+	_, deleted := s.deleted[id]
+	return put || deleted
+}
+
+func (s staged[V]) put(id int, value V) {
+	s.puts[id] = value
+	delete(s.deleted, id)
+}
+
+func (s staged[V]) remove(stored map[int]V, id int) {
+	delete(s.puts, id)
+	if _, ok := stored[id]; ok {
+		s.deleted[id] = struct{}{}
+	}
+}
+
+// View runs fn in a read-only transaction holding the read lock of
+// every collection
+func (db *DB) View(fn func(tx *Tx) error) error {
+	return db.view(collections, fn)
+}
+
+// Update runs fn in a read-write transaction holding the write lock of
+// every collection. The staged changes are handed to the group
+// committer and Update returns once they have been flushed to the log.
+// Transactions writing after them build on them from the moment the
+// locks are released, but readers only see them once they are on
+// disk. If the flush fails, they and every transaction queued behind
+// them are dropped and memory is reloaded from disk. Nothing is kept if
+// fn itself fails.
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	return db.update(collections, fn)
+}
+
+// view runs fn in a read-only transaction on the collections in
+// scope, once every change applied to them has been flushed. Writers
+// cannot apply more while the read locks are held, so this waits for
+// one flush at most.
+func (db *DB) view(scope []string, fn func(tx *Tx) error) error {
+	for {
+		unlock := db.locks.lock(scope, false)
+		if db.commits.waitFlushed(db.locks.applied(scope)) {
+			defer unlock()
+			return fn(newTx(db, false, scope))
+		}
+		// the flush failed and what is in memory is about to be
+		// rolled back
+		unlock()
+		db.commits.waitRecovered()
+	}
+}
+
+// update runs fn in a read-write transaction on the collections in
+// scope. All records of one transaction reach the log in a single
+// write, which is what makes changes to several collections atomic.
+func (db *DB) update(scope []string, fn func(tx *Tx) error) error {
+	unlock := db.locks.lock(scope, true)
+	if db.writeErr != nil {
+		unlock()
+		return db.writeErr
+	}
+	tx := newTx(db, true, scope)
+	if err := fn(tx); err != nil {
+		unlock()
+		return err
+	}
+	records, err := tx.records()
+	if err != nil || len(records) == 0 {
+		unlock()
+		return err
+	}
+	req := &commitRequest{records: records, done: make(chan error, 1)}
+	if err := db.commits.push(req); err != nil {
+		unlock()
+		return err
+	}
+	tx.apply()
+	db.locks.markApplied(scope, req.number)
+	db.raiseChangeSeq(req.records)
+	unlock()
+	return <-req.done
+}
+
+func newTx(db *DB, writable bool, scope []string) *Tx {
+	tx := &Tx{
+		db:        db,
+		writable:  writable,
+		scope:     make(map[string]struct{}, len(scope)),
+		users:     newStaged[User](),
+		chirps:    newStaged[Chirp](),
+		sessions:  newStaged[Session](),
+		sequences: make(map[string]int),
+	}
+	for _, collection := range scope {
+		tx.scope[collection] = struct{}{}
+	}
+	return tx
+}
+
+// panic unless the transaction locked collection
+func (tx *Tx) need(collection string) {
+	if _, ok := tx.scope[collection]; !ok {
+		panic(fmt.Sprintf("database: transaction did not lock %s", collection))
+	}
+}
+
+// fail for read-only transactions, panic for collections out of scope
+func (tx *Tx) write(collection string) error {
+	tx.need(collection)
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	return nil
+}
+
+// User returns the user with the given ID
+func (tx *Tx) User(id int) (User, bool) {
+	tx.need(collectionUsers)
+	return tx.users.get(tx.db.data.Users, id)
+}
+
+// Users returns all users ordered by ID
+func (tx *Tx) Users() []User {
+	tx.need(collectionUsers)
+	users := []User{}
+	for id, user := range tx.db.data.Users {
+		if !tx.users.touched(id) {
+			users = append(users, user)
+		}
+	}
+	for _, user := range tx.users.puts {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users
+}
+
+// UserByEmail returns the user registered with email, compared in
+// the form of NormalizeEmail
+func (tx *Tx) UserByEmail(email string) (User, bool) {
+	tx.need(collectionUsers)
+	email = NormalizeEmail(email)
+	for _, user := range tx.users.puts {
+		if NormalizeEmail(user.Email) == email {
+			return user, true
+		}
+	}
+	id, ok := tx.db.index.userByEmail[email]
+	if !ok {
+		return User{}, false
+	}
+	// the indexed user may have been changed in this transaction
+	user, ok := tx.User(id)
+	if !ok || NormalizeEmail(user.Email) != email {
+		return User{}, false
+	}
+	return user, true
+}
+
+// InsertUser stores a new user and returns it with its assigned ID
+func (tx *Tx) InsertUser(user User) (User, error) {
+	if err := tx.write(collectionUsers); err != nil {
+		return User{}, err
+	}
+	user.ID = tx.nextID(collectionUsers)
+	return user, tx.PutUser(user)
+}
+
+// PutUser stores user under user.ID
+func (tx *Tx) PutUser(user User) error {
+	if err := tx.write(collectionUsers); err != nil {
+		return err
+	}
+	tx.users.put(user.ID, user)
+	tx.bumpSequence(collectionUsers, user.ID)
+	return nil
+}
+
+// DeleteUser removes the user stored under id. Their chirps and
+// sessions are kept, delete those in the same transaction if needed.
+func (tx *Tx) DeleteUser(id int) error {
+	if err := tx.write(collectionUsers); err != nil {
+		return err
+	}
+	tx.users.remove(tx.db.data.Users, id)
+	return nil
+}
+
+// Chirp returns the chirp stored under id
+func (tx *Tx) Chirp(id int) (Chirp, bool) {
+	tx.need(collectionChirps)
+	return tx.chirps.get(tx.db.data.Chirps, id)
+}
+
+// Chirps returns all chirps ordered by ID
+func (tx *Tx) Chirps() []Chirp {
+	tx.need(collectionChirps)
+	chirps := []Chirp{}
+	for id := range tx.db.data.Chirps {
+		if !tx.chirps.touched(id) {
+			chirps = appendChirp(chirps, tx.db.data.Chirps[id])
+		}
+	}
+	for _, chirp := range tx.chirps.puts {
+		chirps = appendChirp(chirps, chirp)
+	}
+	sortChirps(chirps)
+	return chirps
+}
+
+// ChirpsByAuthor returns the chirps of one author ordered by ID
+func (tx *Tx) ChirpsByAuthor(authorID int) []Chirp {
+	tx.need(collectionChirps)
+	chirps := []Chirp{}
+	for id := range tx.db.index.chirpsByAuthor[authorID] {
+		if !tx.chirps.touched(id) {
+			chirps = appendChirp(chirps, tx.db.data.Chirps[id])
+		}
+	}
+	for _, chirp := range tx.chirps.puts {
+		if chirp.AuthorID == authorID {
+			chirps = appendChirp(chirps, chirp)
+		}
+	}
+	sortChirps(chirps)
+	return chirps
+}
+
+// deleted chirps are left out of listings
+func appendChirp(chirps []Chirp, chirp Chirp) []Chirp {
+	if chirp.IsDeleted() {
+		return chirps
+	}
+	return append(chirps, chirp)
+}
+
+// InsertChirp stores a new chirp and returns it with its assigned ID
+func (tx *Tx) InsertChirp(chirp Chirp) (Chirp, error) {
+	if err := tx.write(collectionChirps); err != nil {
+		return Chirp{}, err
+	}
+	chirp.ID = tx.nextID(collectionChirps)
+	return chirp, tx.PutChirp(chirp)
+}
+
+// PutChirp stores chirp under chirp.ID
+func (tx *Tx) PutChirp(chirp Chirp) error {
+	if err := tx.write(collectionChirps); err != nil {
+		return err
+	}
+	tx.chirps.put(chirp.ID, chirp)
+	tx.bumpSequence(collectionChirps, chirp.ID)
+	return nil
+}
+
+// DeleteChirp removes the chirp stored under id for good, unlike
+// DB.DeleteChirp which leaves a tombstone
+func (tx *Tx) DeleteChirp(id int) error {
+	if err := tx.write(collectionChirps); err != nil {
+		return err
+	}
+	tx.chirps.remove(tx.db.data.Chirps, id)
+	return nil
+}
+
+// Session returns the session stored under id
+func (tx *Tx) Session(id int) (Session, bool) {
+	tx.need(collectionSessions)
+	return tx.sessions.get(tx.db.data.Sessions, id)
+}
+
+// Sessions returns all sessions ordered by ID
+func (tx *Tx) Sessions() []Session {
+	tx.need(collectionSessions)
+	sessions := []Session{}
+	for id, session := range tx.db.data.Sessions {
+		if !tx.sessions.touched(id) {
+			sessions = append(sessions, session)
+		}
+	}
+	for _, session := range tx.sessions.puts {
+		sessions = append(sessions, session)
+	}
+	sortSessions(sessions)
+	return sessions
+}
+
+// SessionByToken returns the session holding the hash of refreshToken
+func (tx *Tx) SessionByToken(refreshToken string) (Session, bool) {
+	tx.need(collectionSessions)
+	if refreshToken == "" {
+		return Session{}, false
+	}
+	hash := HashRefreshToken(refreshToken)
+	for _, session := range tx.sessions.puts {
+		if session.TokenHash == hash {
+			return session, true
+		}
+	}
+	id, ok := tx.db.index.sessionByTokenHash[hash]
+	if !ok {
+		return Session{}, false
+	}
+	session, ok := tx.Session(id)
+	if !ok || session.TokenHash != hash {
+		return Session{}, false
+	}
+	return session, true
+}
+
+// SessionByRotatedToken returns the session a refresh replaced
+// refreshToken in
+func (tx *Tx) SessionByRotatedToken(refreshToken string) (Session, bool) {
+	tx.need(collectionSessions)
+	if refreshToken == "" {
+		return Session{}, false
+	}
+	hash := HashRefreshToken(refreshToken)
+	for _, session := range tx.sessions.puts {
+		if slices.Contains(session.RotatedTokenHashes, hash) {
+			return session, true
+		}
+	}
+	id, ok := tx.db.index.sessionByRotatedHash[hash]
+	if !ok {
+		return Session{}, false
+	}
+	session, ok := tx.Session(id)
+	if !ok || !slices.Contains(session.RotatedTokenHashes, hash) {
+		return Session{}, false
+	}
+	return session, true
+}
+
+// SessionsByUser returns the sessions of one user ordered by ID
+func (tx *Tx) SessionsByUser(userID int) []Session {
+	tx.need(collectionSessions)
+	sessions := []Session{}
+	for id := range tx.db.index.sessionsByUser[userID] {
+		if !tx.sessions.touched(id) {
+			sessions = append(sessions, tx.db.data.Sessions[id])
+		}
+	}
+	for _, session := range tx.sessions.puts {
+		if session.UserID == userID {
+			sessions = append(sessions, session)
+		}
+	}
+	sortSessions(sessions)
+	return sessions
+}
+
+func sortSessions(sessions []Session) {
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+}
+
+// InsertSession stores a new session and returns it with its assigned
+// ID
+func (tx *Tx) InsertSession(session Session) (Session, error) {
+	if err := tx.write(collectionSessions); err != nil {
+		return Session{}, err
+	}
+	session.ID = tx.nextID(collectionSessions)
+	return session, tx.PutSession(session)
+}
+
+// PutSession stores session under session.ID
+func (tx *Tx) PutSession(session Session) error {
+	if err := tx.write(collectionSessions); err != nil {
+		return err
+	}
+	tx.sessions.put(session.ID, session)
+	tx.bumpSequence(collectionSessions, session.ID)
+	return nil
+}
+
+// DeleteSession removes the session stored under id, revoking its
+// refresh token
+func (tx *Tx) DeleteSession(id int) error {
+	if err := tx.write(collectionSessions); err != nil {
+		return err
+	}
+	tx.sessions.remove(tx.db.data.Sessions, id)
+	return nil
+}
+
+// Sequence returns the last ID handed out in collection
+func (tx *Tx) Sequence(collection string) int {
+	tx.need(collection)
+	seq, ok := tx.sequences[collection]
+	if !ok {
+		seq = tx.db.sequence(collection)
+	}
+	return seq
+}
+
+// advance the collection's sequence and return the new ID
+func (tx *Tx) nextID(collection string) int {
+	seq := tx.Sequence(collection) + 1
+	tx.sequences[collection] = seq
+	return seq
+}
+
+// raise the collection's sequence to at least id, as log replay does
+func (tx *Tx) bumpSequence(collection string, id int) {
+	if tx.Sequence(collection) < id {
+		tx.sequences[collection] = id
+	}
+}
+
+func sortedKeys[V any](m map[int]V) []int {
+	keys := make([]int, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+func sortedStrings[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func maxKey[V any](m map[int]V) int {
+	highest := 0
+	for key := range m {
+		highest = max(highest, key)
+	}
+	return highest
+}
+
+// log records for the staged changes of one collection, which holds
+// stored before the transaction
+func stagedRecords[V any](collection string, s staged[V], stored map[int]V) ([]logRecord, error) {
+	records := []logRecord{}
+	for _, id := range sortedKeys(s.deleted) {
+		records = append(records, newDeleteRecord(collection, id))
+	}
+	for _, id := range sortedKeys(s.puts) {
+		record, err := newPutRecord(collection, id, s.puts[id])
+		if err != nil {
+			return nil, err
+		}
+		_, exists := stored[id]
+		record.Created = !exists
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// log records for the staged changes
+func (tx *Tx) records() ([]logRecord, error) {
+	records := []logRecord{}
+	for _, next := range []func() ([]logRecord, error){
+		func() ([]logRecord, error) { return stagedRecords(collectionUsers, tx.users, tx.db.data.Users) },
+		func() ([]logRecord, error) { return stagedRecords(collectionChirps, tx.chirps, tx.db.data.Chirps) },
+		func() ([]logRecord, error) {
+			return stagedRecords(collectionSessions, tx.sessions, tx.db.data.Sessions)
+		},
+	} {
+		collectionRecords, err := next()
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, collectionRecords...)
+	}
+	// replaying the puts raises the sequences to the highest stored
+	// ID, anything beyond that needs its own record
+	for _, collection := range sortedStrings(tx.sequences) {
+		if tx.sequences[collection] > tx.highestPut(collection) {
+			records = append(records, newSequenceRecord(collection, tx.sequences[collection]))
+		}
+	}
+	return records, nil
+}
+
+func (tx *Tx) highestPut(collection string) int {
+	switch collection {
+	case collectionUsers:
+		return maxKey(tx.users.puts)
+	case collectionChirps:
+		return maxKey(tx.chirps.puts)
+	case collectionSessions:
+		return maxKey(tx.sessions.puts)
+	}
+	return 0
+}
+
+// apply the staged changes to DB.data
+func (tx *Tx) apply() {
+	for id := range tx.users.deleted {
+		tx.db.deleteUser(id)
+	}
+	for _, user := range tx.users.puts {
+		tx.db.putUser(user)
+	}
+	for id := range tx.chirps.deleted {
+		tx.db.deleteChirp(id)
+	}
+	for _, chirp := range tx.chirps.puts {
+		tx.db.putChirp(chirp)
+	}
+	for id := range tx.sessions.deleted {
+		tx.db.deleteSession(id)
+	}
+	for _, session := range tx.sessions.puts {
+		tx.db.putSession(session)
+	}
+	tx.db.seqMux.Lock()
+	defer tx.db.seqMux.Unlock()
+	for collection, seq := range tx.sequences {
+		tx.db.data.Sequences[collection] = seq
+	}
+}
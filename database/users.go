@@ -2,118 +2,145 @@ package database
 
 import (
 	"errors"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
 var ErrNotExist = errors.New("resources not found")
 
+var ErrEmailTaken = errors.New("email is already in use")
+
+// NormalizeEmail returns the form emails are stored and looked up in,
+// so that addresses differing only in case or surrounding spaces
+// belong to the same user
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// bcrypt cost passwords are hashed at, lowered by the tests
+var passwordCost = bcrypt.DefaultCost
+
+// bcrypt hash at bcrypt.DefaultCost compared against when nobody uses
+// the email, so that a failed login takes as long whether the email
+// exists or not
+var dummyPasswordHash = []byte("$2a$10$onif6XJ3zcHAhV3fmRMZ7OIOlz4vNso74MDDedACH3DTEbpWm3zgS")
+
+// check password against the hash of user, which was found or not,
+// always running bcrypt once
+func passwordMatches(user User, found bool, password string) bool {
+	hash := user.Password
+	if !found {
+		hash = dummyPasswordHash
+	}
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+	return found && err == nil
+}
+
 // create new User and write new DB.data to disk
 func (db *DB) CreateUser(email string, password string) (UserWithoutPW, error) {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-	hashedPassword, err1 := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err1 != nil {
-		return UserWithoutPW{}, err1
-	}
-	newUser := User{
-		ID:          len(db.Data.Users) + 1,
-		Password:    hashedPassword,
-		Email:       email,
-		IsChirpyRed: false,
-	}
-	db.Data.Users[newUser.ID] = newUser
-	err2 := db.writeDBtoDisk()
-	if err2 != nil {
-		return UserWithoutPW{}, err2
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return UserWithoutPW{}, err
 	}
-	newUserWoPW := UserWithoutPW{
-		ID:          newUser.ID,
-		Email:       newUser.Email,
-		IsChirpyRed: newUser.IsChirpyRed,
+	email = NormalizeEmail(email)
+	newUser := User{}
+	err = db.update([]string{collectionUsers}, func(tx *Tx) error {
+		if _, ok := tx.UserByEmail(email); ok {
+			return ErrEmailTaken
+		}
+		var err error
+		newUser, err = tx.InsertUser(User{
+			Password:    hashedPassword,
+			Email:       email,
+			IsChirpyRed: false,
+		})
+		return err
+	})
+	if err != nil {
+		return UserWithoutPW{}, err
 	}
-	return newUserWoPW, nil
+	return withoutPassword(newUser), nil
 }
 
-// Login user
-func (db *DB) IdentifyUser(password string) (UserWithoutPW, bool) {
-	usersMap := db.Data.Users
-	for _, user := range usersMap {
-		err := bcrypt.CompareHashAndPassword(user.Password, []byte(password))
-		if err == nil {
-			return UserWithoutPW{
-				ID:          user.ID,
-				Email:       user.Email,
-				IsChirpyRed: user.IsChirpyRed,
-			}, true
-		}
+// IdentifyUser returns the user registered with email if password is
+// theirs. It takes as long for unknown emails as for wrong passwords.
+func (db *DB) IdentifyUser(email, password string) (UserWithoutPW, bool) {
+	user := User{}
+	found := false
+	db.view([]string{collectionUsers}, func(tx *Tx) error {
+		user, found = tx.UserByEmail(email)
+		return nil
+	})
+	if !passwordMatches(user, found, password) {
+		return UserWithoutPW{}, false
 	}
-	return UserWithoutPW{}, false
+	return withoutPassword(user), true
 }
 
 // Update user info
-func (db *DB) UpdateUser(userID int, email, password string) (UserWithoutPW, bool) {
-	for id, user := range db.Data.Users {
-		if id == userID {
-			hashedPassword, err1 := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-			if err1 != nil {
-				return UserWithoutPW{}, false
-			}
-			db.Data.Users[id] = User{
-				ID:           user.ID,
-				Email:        email,
-				Password:     hashedPassword,
-				RefreshToken: user.RefreshToken,
-			}
-
-			err := db.writeDBtoDisk()
-			if err != nil {
-				panic(err)
-			}
-			return UserWithoutPW{
-				ID:          userID,
-				Email:       email,
-				IsChirpyRed: user.IsChirpyRed,
-			}, true
+func (db *DB) UpdateUser(userID int, email, password string) (UserWithoutPW, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return UserWithoutPW{}, err
+	}
+	email = NormalizeEmail(email)
+	user := User{}
+	err = db.update([]string{collectionUsers}, func(tx *Tx) error {
+		var ok bool
+		user, ok = tx.User(userID)
+		if !ok {
+			return ErrNotExist
+		}
+		if other, ok := tx.UserByEmail(email); ok && other.ID != userID {
+			return ErrEmailTaken
 		}
+		user.Email = email
+		user.Password = hashedPassword
+		return tx.PutUser(user)
+	})
+	if err != nil {
+		return UserWithoutPW{}, err
 	}
-	return UserWithoutPW{}, false
+	return withoutPassword(user), nil
 }
 
-// Login user and save refresh token to database
-func (db *DB) LoginUser(userID int, refreshToken string) {
-	for id, user := range db.Data.Users {
-		if id == userID {
-			db.Data.Users[id] = User{
-				ID:           user.ID,
-				Email:        user.Email,
-				Password:     user.Password,
-				RefreshToken: refreshToken,
+// DeleteUser removes a user, turns their chirps into tombstones and
+// closes their sessions. The records of all three collections
+// reach the log in one write, so a crash keeps all or none of it.
+func (db *DB) DeleteUser(userID int) error {
+	return db.update([]string{collectionUsers, collectionChirps, collectionSessions}, func(tx *Tx) error {
+		if _, ok := tx.User(userID); !ok {
+			return ErrNotExist
+		}
+		if err := tx.DeleteUser(userID); err != nil {
+			return err
+		}
+		deletedAt := time.Now().UTC()
+		for _, chirp := range tx.ChirpsByAuthor(userID) {
+			chirp.DeletedAt = &deletedAt
+			if err := tx.PutChirp(chirp); err != nil {
+				return err
 			}
-			err := db.writeDBtoDisk()
-			if err != nil {
-				panic(err)
+		}
+		for _, session := range tx.SessionsByUser(userID) {
+			if err := tx.DeleteSession(session.ID); err != nil {
+				return err
 			}
 		}
-	}
+		return nil
+	})
 }
 
+// IsChirpyRed upgrades the user to Chirpy Red
 func (db *DB) IsChirpyRed(userID int) error {
-	for id, user := range db.Data.Users {
-		if id == userID {
-			db.Data.Users[id] = User{
-				ID:           user.ID,
-				Email:        user.Email,
-				Password:     user.Password,
-				RefreshToken: user.RefreshToken,
-				IsChirpyRed:  true,
-			}
-			err := db.writeDBtoDisk()
-			if err != nil {
-				panic(err)
-			}
-			return nil
+	return db.update([]string{collectionUsers}, func(tx *Tx) error {
+		user, ok := tx.User(userID)
+		if !ok {
+			return ErrNotExist
 		}
-	}
-	return ErrNotExist
+		user.IsChirpyRed = true
+		return tx.PutUser(user)
+	})
 }
@@ -0,0 +1,323 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+)
+
+// number of log records after which the log is folded into the snapshot
+const compactThreshold = 1000
+
+const (
+	collectionChirps   = "chirps"
+	collectionUsers    = "users"
+	collectionSessions = "sessions"
+	sequencesKey       = "sequences"
+	changeSeqKey       = "change_seq"
+)
+
+const (
+	opPut    = "put"
+	opDelete = "delete"
+	// raises the sequence of Collection to ID
+	opSequence = "sequence"
+)
+
+// logRecord is a single mutation appended to the write-ahead log
+type logRecord struct {
+	Op         string          `json:"op"`
+	Collection string          `json:"collection"`
+	ID         int             `json:"id"`
+	Value      json.RawMessage `json:"value,omitempty"`
+	// position of a put or delete in the change feed
+	Seq int64 `json:"seq,omitempty"`
+	// whether a put created the record
+	Created bool `json:"created,omitempty"`
+}
+
+func logPath(path string) string {
+	return path + ".log"
+}
+
+func newPutRecord(collection string, id int, v any) (logRecord, error) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return logRecord{}, err
+	}
+	return logRecord{
+		Op:         opPut,
+		Collection: collection,
+		ID:         id,
+		Value:      value,
+	}, nil
+}
+
+func newDeleteRecord(collection string, id int) logRecord {
+	return logRecord{
+		Op:         opDelete,
+		Collection: collection,
+		ID:         id,
+	}
+}
+
+func newSequenceRecord(collection string, seq int) logRecord {
+	return logRecord{
+		Op:         opSequence,
+		Collection: collection,
+		ID:         seq,
+	}
+}
+
+// append records to the log in a single write and fsync it. If the
+// write fails the log is cut back so no partial record is left behind.
+func (db *DB) appendLog(records ...logRecord) error {
+	if err := db.checkUnmodified(); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		line, err = db.keys.seal(line, purposeLog)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	_, err := db.log.Write(buf.Bytes())
+	if err == nil {
+		err = db.log.Sync()
+	}
+	if err != nil {
+		if truncErr := db.log.Truncate(db.logSize); truncErr != nil {
+			log.Printf("database: cannot roll back log after failed append: %v", truncErr)
+		}
+		return err
+	}
+	db.logSize += int64(buf.Len())
+	db.logRecords += len(records)
+	return nil
+}
+
+// fold the log into the snapshot once it grows past compactThreshold.
+// Only called by the committer, which owns the log. While the database
+// is in use it is retried after every batch until it gets the locks.
+func (db *DB) maybeCompact() {
+	if db.logRecords < compactThreshold {
+		return
+	}
+	unlock, ok := db.tryLockAll()
+	if !ok {
+		return
+	}
+	defer unlock()
+	// queued transactions are in memory but not in the log yet,
+	// so wait for a moment where the snapshot would match the log
+	if db.commits.len() > 0 {
+		return
+	}
+	// the records are already durable in the log, so a failed
+	// compaction only delays folding them into the snapshot
+	if err := db.compact(); err != nil {
+		log.Printf("database: compaction failed: %v", err)
+	}
+}
+
+// write the full snapshot and the retained changes to disk and empty
+// the log
+func (db *DB) compact() error {
+	if err := db.writeDBtoDisk(); err != nil {
+		return err
+	}
+	if err := db.writeRetainedChanges(); err != nil {
+		return err
+	}
+	return db.truncateLog()
+}
+
+// empty the log
+func (db *DB) truncateLog() error {
+	if err := db.log.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := db.log.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	db.logRecords = 0
+	db.logSize = 0
+	return db.log.Sync()
+}
+
+// open the log for appending
+func (db *DB) openLog() error {
+	f, err := db.fsys.OpenFile(logPath(db.path), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	db.log = f
+	db.logSize = info.Size()
+	return nil
+}
+
+// replay the log at path through apply and return the number of
+// records applied. A torn record at the end of the log (a crash in
+// the middle of an append) is skipped, and cut off with truncate.
+func replayLog(fsys FS, path string, apply func(logRecord) error, keys *keyring, truncate bool) (int, error) {
+	flag := os.O_RDONLY
+	if truncate {
+		flag = os.O_RDWR
+	}
+	f, err := fsys.OpenFile(path, flag, 0600)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var offset int64
+	records := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 && truncate {
+				return records, f.Truncate(offset)
+			}
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		plain, _, err := keys.open(line, purposeLog)
+		if err != nil {
+			return records, fmt.Errorf("log record at offset %d: %w", offset, err)
+		}
+		record := logRecord{}
+		if err := json.Unmarshal(plain, &record); err != nil {
+			return records, fmt.Errorf("corrupt log record at offset %d: %w", offset, err)
+		}
+		if err := apply(record); err != nil {
+			return records, fmt.Errorf("cannot apply log record at offset %d: %w", offset, err)
+		}
+		offset += int64(len(line))
+		records++
+	}
+}
+
+// apply a log record to the document
+func (doc document) apply(record logRecord) error {
+	if record.Seq > int64(intValue(doc[changeSeqKey])) {
+		doc[changeSeqKey] = json.Number(strconv.FormatInt(record.Seq, 10))
+	}
+	switch record.Op {
+	case opPut:
+	case opDelete:
+		delete(doc.collection(record.Collection), strconv.Itoa(record.ID))
+		return nil
+	case opSequence:
+		doc.bumpSequence(record.Collection, record.ID)
+		return nil
+	default:
+		return fmt.Errorf("unknown op %q", record.Op)
+	}
+	value, err := decodeValue(record.Value)
+	if err != nil {
+		return err
+	}
+	doc.collection(record.Collection)[strconv.Itoa(record.ID)] = value
+	doc.bumpSequence(record.Collection, record.ID)
+	return nil
+}
+
+// apply a log record to typed data. Only valid when the data is at
+// the current schema version, which the log always is.
+func (data *DbData) apply(record logRecord) error {
+	data.ChangeSeq = max(data.ChangeSeq, record.Seq)
+	switch record.Op {
+	case opPut:
+		switch record.Collection {
+		case collectionUsers:
+			user := User{}
+			if err := json.Unmarshal(record.Value, &user); err != nil {
+				return err
+			}
+			data.Users[record.ID] = user
+		case collectionChirps:
+			chirp := Chirp{}
+			if err := json.Unmarshal(record.Value, &chirp); err != nil {
+				return err
+			}
+			data.Chirps[record.ID] = chirp
+		case collectionSessions:
+			session := Session{}
+			if err := json.Unmarshal(record.Value, &session); err != nil {
+				return err
+			}
+			data.Sessions[record.ID] = session
+		default:
+			return fmt.Errorf("unknown collection %q", record.Collection)
+		}
+	case opDelete:
+		switch record.Collection {
+		case collectionUsers:
+			delete(data.Users, record.ID)
+		case collectionChirps:
+			delete(data.Chirps, record.ID)
+		case collectionSessions:
+			delete(data.Sessions, record.ID)
+		default:
+			return fmt.Errorf("unknown collection %q", record.Collection)
+		}
+		return nil
+	case opSequence:
+	default:
+		return fmt.Errorf("unknown op %q", record.Op)
+	}
+	if data.Sequences[record.Collection] < record.ID {
+		data.Sequences[record.Collection] = record.ID
+	}
+	return nil
+}
+
+// Close stops scheduled backups and retention, waits for pending
+// commits, wakes the change feed waiters, folds the log into the
+// snapshot and closes the log file
+func (db *DB) Close() error {
+	db.stopBackups()
+	db.stopRetention()
+	db.commits.close()
+	<-db.committerDone
+	db.feed.close()
+	unlock := db.lockAll()
+	defer unlock()
+	if db.log == nil {
+		return nil
+	}
+	err := db.writeErr
+	if err == nil {
+		err = db.compact()
+	}
+	if closeErr := db.log.Close(); err == nil {
+		err = closeErr
+	}
+	db.log = nil
+	db.lock.Close()
+	return err
+}
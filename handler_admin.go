@@ -0,0 +1,32 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/hale-pretty/chirpy/database"
+	"github.com/hale-pretty/chirpy/internal/auth"
+)
+
+// check the ADMIN_API_KEY of an admin request and that the file
+// database is in use, responding with an error if not
+func (cfg *apiConfig) authorizeAdmin(w http.ResponseWriter, r *http.Request) (*database.DB, bool) {
+	if cfg.adminAPIKey == "" {
+		respondWithError(w, http.StatusForbidden, "Admin API is disabled")
+		return nil, false
+	}
+	APIKey, err := auth.GetAPIkey(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Cannot find api key")
+		return nil, false
+	}
+	if subtle.ConstantTimeCompare([]byte(APIKey), []byte(cfg.adminAPIKey)) != 1 {
+		respondWithError(w, http.StatusUnauthorized, "API key is invalid")
+		return nil, false
+	}
+	if cfg.fileDB == nil {
+		respondWithError(w, http.StatusNotImplemented, "Not available with the in-memory store")
+		return nil, false
+	}
+	return cfg.fileDB, true
+}
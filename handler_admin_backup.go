@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+func (cfg *apiConfig) backupHandler(w http.ResponseWriter, r *http.Request) {
+	// 1. Check API Key
+	db, ok := cfg.authorizeAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	// 2. Stream a snapshot in the format of database.json
+	filename := fmt.Sprintf("chirpy-backup-%s.json", time.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	if err := db.Backup(w); err != nil {
+		log.Printf("Backup failed: %v", err)
+	}
+}
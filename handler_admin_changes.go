@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hale-pretty/chirpy/database"
+)
+
+// longest a consumer may wait for new changes in one request
+const maxChangesWait = time.Minute
+
+// changesHandler serves the change feed without password and refresh
+// token hashes
+func (cfg *apiConfig) changesHandler(w http.ResponseWriter, r *http.Request) {
+	cfg.serveChanges(w, r, true)
+}
+
+// replicationChangesHandler serves the full change feed replicas apply,
+// as complete as the backup they start from
+func (cfg *apiConfig) replicationChangesHandler(w http.ResponseWriter, r *http.Request) {
+	cfg.serveChanges(w, r, false)
+}
+
+func (cfg *apiConfig) serveChanges(w http.ResponseWriter, r *http.Request, redact bool) {
+	// 1. Check API Key
+	db, ok := cfg.authorizeAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	// 2. Read where to resume, how many changes and how long to wait
+	query := r.URL.Query()
+	since := int64(0)
+	if query.Has("since") {
+		n, err := strconv.ParseInt(query.Get("since"), 10, 64)
+		if err != nil || n < 0 {
+			respondWithError(w, http.StatusBadRequest, "since must be a change seq")
+			return
+		}
+		since = n
+	}
+	limit := 0
+	if query.Has("limit") {
+		n, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || n <= 0 {
+			respondWithError(w, http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+		limit = n
+	}
+	wait := time.Duration(0)
+	if query.Has("wait") {
+		d, err := time.ParseDuration(query.Get("wait"))
+		if err != nil || d < 0 {
+			respondWithError(w, http.StatusBadRequest, "wait must be a duration like 30s")
+			return
+		}
+		wait = min(d, maxChangesWait)
+	}
+
+	// 3. Long poll until there is something after since
+	if wait > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		err := db.WaitForChanges(ctx, since)
+		cancel()
+		if r.Context().Err() != nil {
+			return
+		}
+		// a timeout just answers with no changes
+		if errors.Is(err, database.ErrClosed) {
+			respondWithError(w, http.StatusServiceUnavailable, "Database is closing")
+			return
+		}
+	}
+
+	// 4. Respond with the page
+	page, err := db.Changes(since, limit)
+	if err != nil {
+		if errors.Is(err, database.ErrChangesExpired) {
+			respondWithError(w, http.StatusGone, "Changes since "+strconv.FormatInt(since, 10)+" are no longer retained, start over from /admin/backup")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read changes")
+		return
+	}
+	if redact {
+		page = page.Redacted()
+	}
+	respondWithJSON(w, http.StatusOK, page)
+}
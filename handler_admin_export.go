@@ -0,0 +1,23 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+func (cfg *apiConfig) exportHandler(w http.ResponseWriter, r *http.Request) {
+	// 1. Check API Key
+	db, ok := cfg.authorizeAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	// 2. Stream the export
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="chirpy-export.ndjson"`)
+	w.WriteHeader(http.StatusOK)
+	// the status is already sent, so a failure can only cut the body short
+	if err := db.Export(w); err != nil {
+		log.Printf("Export failed: %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/hale-pretty/chirpy/database"
+)
+
+func (cfg *apiConfig) importHandler(w http.ResponseWriter, r *http.Request) {
+	// 1. Check API Key
+	db, ok := cfg.authorizeAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	// 2. Read the mode, merge unless asked otherwise
+	mode := database.ImportMerge
+	if r.URL.Query().Has("mode") {
+		mode = database.ImportMode(r.URL.Query().Get("mode"))
+	}
+
+	// 3. Import the NDJSON body
+	result, err := db.Import(r.Body, mode)
+	if err != nil {
+		if errors.Is(err, database.ErrInvalidImport) {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't import data")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+func (cfg *apiConfig) retentionHandler(w http.ResponseWriter, r *http.Request) {
+	// 1. Check API Key
+	db, ok := cfg.authorizeAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	// 2. Remove what the retention policy no longer keeps
+	report, err := db.ApplyRetention(time.Now())
+	if err != nil {
+		log.Printf("Retention failed: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't apply retention")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, report)
+}
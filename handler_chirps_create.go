@@ -3,10 +3,12 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
 
+	"github.com/hale-pretty/chirpy/database"
 	"github.com/hale-pretty/chirpy/internal/auth"
 )
 
@@ -33,7 +35,7 @@ func (cfg *apiConfig) createChirpHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	// Parse and validate the JWT
-	userIDStr, err := auth.ValidateJWT(tokenString, cfg.jwtSecret)
+	userIDStr, err := auth.ValidateJWT(tokenString, cfg.jwtKeys)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, fmt.Sprintf("Cannot validate JWT: %v", err))
 		return
@@ -45,14 +47,12 @@ func (cfg *apiConfig) createChirpHandler(w http.ResponseWriter, r *http.Request)
 	chirpRequest := ChirpRequest{}
 	err = decoder.Decode(&chirpRequest)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
 		respondWithError(w, http.StatusBadRequest, "Something went wrong")
 		return
 	}
 
 	// 3. Validate chirp body
-	if len(chirpRequest.Body) > 140 {
-		w.WriteHeader(http.StatusBadRequest)
+	if database.ChirpTooLong(chirpRequest.Body) {
 		respondWithError(w, http.StatusBadRequest, "Something went wrong")
 		return
 	}
@@ -62,7 +62,9 @@ func (cfg *apiConfig) createChirpHandler(w http.ResponseWriter, r *http.Request)
 	// 4. Create Chirp
 	chirp, err := cfg.DB.CreateChirp(cleanedBody, userID)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, err.Error())
+		log.Printf("Creating chirp failed: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create chirp")
+		return
 	}
 	respondWithJSON(w, 201, chirp)
 }
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 
+	"github.com/hale-pretty/chirpy/database"
 	"github.com/hale-pretty/chirpy/internal/auth"
 )
 
@@ -16,7 +19,7 @@ func (cfg *apiConfig) deleteChirpHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	// Parse and validate the JWT
-	userIDStr, err := auth.ValidateJWT(tokenString, cfg.jwtSecret)
+	userIDStr, err := auth.ValidateJWT(tokenString, cfg.jwtKeys)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, fmt.Sprintf("Cannot validate JWT: %v", err))
 		return
@@ -33,8 +36,21 @@ func (cfg *apiConfig) deleteChirpHandler(w http.ResponseWriter, r *http.Request)
 
 	// 3. Delete chirp in the database
 	err = cfg.DB.DeleteChirp(userID, chirpIdInt)
+	if errors.Is(err, database.ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "Chirp not found")
+		return
+	}
+	if errors.Is(err, database.ErrDeleted) {
+		respondWithError(w, http.StatusGone, "Chirp has been deleted")
+		return
+	}
+	if errors.Is(err, database.ErrNotAuthor) {
+		respondWithError(w, http.StatusForbidden, "Cannot delete chirps of others")
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusForbidden, fmt.Sprintf("Cannot delete this chirp: %v", err))
+		log.Printf("Deleting chirp %d failed: %v", chirpIdInt, err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete chirp")
 		return
 	}
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 
@@ -16,6 +17,10 @@ func (cfg *apiConfig) getChirpsByChirpIdHandler(w http.ResponseWriter, r *http.R
 	}
 
 	dbChirp, err := cfg.DB.GetChirpByChirpId(chirpID)
+	if errors.Is(err, database.ErrDeleted) {
+		respondWithError(w, http.StatusGone, "Chirp has been deleted")
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusNotFound, "Couldn't get chirp")
 		return
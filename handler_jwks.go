@@ -0,0 +1,10 @@
+package main
+
+import "net/http"
+
+// serve the public keys access tokens are signed with, for other
+// services to verify them without the server's secrets
+func (cfg *apiConfig) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, http.StatusOK, cfg.jwtKeys.JWKS())
+}
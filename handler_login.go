@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"time"
 
 	"github.com/hale-pretty/chirpy/internal/auth"
 )
@@ -12,6 +13,7 @@ type LoginUser struct {
 	Email            string `json:"email"`
 	JwtToken1        string `json:"token"`
 	JwtRefreshToken1 string `json:"refresh_token"`
+	SessionID        int    `json:"session_id"`
 	IsChirpyRed      bool   `json:"is_chirpy_red"`
 }
 
@@ -20,14 +22,15 @@ func (cfg *apiConfig) loginUsersHandler(w http.ResponseWriter, r *http.Request)
 	userRequest := UserRequest{}
 	err := decoder.Decode(&userRequest)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
 		respondWithError(w, http.StatusBadRequest, "Something went wrong")
 		return
 	}
-	// userRequest is a struct with data populated successfully
-	userWoPW, ok := cfg.DB.IdentifyUser(userRequest.Password)
+	// userRequest is a struct with data populated successfully.
+	// Unknown emails and wrong passwords get the same answer after the
+	// same time, so that logins don't tell which emails are registered
+	userWoPW, ok := cfg.DB.IdentifyUser(userRequest.Email, userRequest.Password)
 	if !ok {
-		respondWithError(w, http.StatusUnauthorized, "Invalid user")
+		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password")
 		return
 	}
 	var expireInSeconds = userRequest.ExpiresInSeconds
@@ -35,7 +38,7 @@ func (cfg *apiConfig) loginUsersHandler(w http.ResponseWriter, r *http.Request)
 		expireInSeconds = defaultExpireInSecond
 	}
 	// create access token
-	token, err := auth.CreateJWT(cfg.jwtSecret, userWoPW.ID, expireInSeconds)
+	token, err := auth.CreateJWT(cfg.jwtKeys, userWoPW.ID, expireInSeconds)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Error creating token")
 		return
@@ -46,14 +49,19 @@ func (cfg *apiConfig) loginUsersHandler(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token")
 		return
 	}
-	// Save refresh token to database
-	cfg.DB.LoginUser(userWoPW.ID, refreshToken)
+	// Open a session for this device, the user's others stay open
+	session, err := cfg.DB.CreateSession(userWoPW.ID, refreshToken, time.Now().Add(cfg.refreshTokenTTL), sessionClient(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create session")
+		return
+	}
 
 	loginUser := LoginUser{
 		ID:               userWoPW.ID,
 		Email:            userWoPW.Email,
 		JwtToken1:        token,
 		JwtRefreshToken1: refreshToken,
+		SessionID:        session.ID,
 		IsChirpyRed:      userWoPW.IsChirpyRed,
 	}
 	respondWithJSON(w, 200, loginUser)
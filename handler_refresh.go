@@ -1,14 +1,18 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
+	"github.com/hale-pretty/chirpy/database"
 	"github.com/hale-pretty/chirpy/internal/auth"
 )
 
 type AccessToken struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
 }
 
 func (cfg *apiConfig) refreshHandler(w http.ResponseWriter, r *http.Request) {
@@ -18,20 +22,46 @@ func (cfg *apiConfig) refreshHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userID, refreshTokenOk := cfg.DB.RefreshNewAccessToken(tokenString)
-	if !refreshTokenOk {
+	// every refresh token is used once, the client gets the next one
+	newRefreshToken, err := auth.MakeRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token")
+		return
+	}
+	session, err := cfg.DB.RotateRefreshToken(tokenString, newRefreshToken, time.Now().Add(cfg.refreshTokenTTL))
+	if errors.Is(err, database.ErrRefreshTokenReused) {
+		// either the client or a thief holds a copy of the token, the
+		// session was closed for both
+		cfg.audit.record(r, auditEvent{
+			Event:     auditRefreshTokenReuse,
+			UserID:    session.UserID,
+			SessionID: session.ID,
+		})
+		respondWithError(w, http.StatusUnauthorized, "Invalid token")
+		return
+	}
+	if errors.Is(err, database.ErrRefreshTokenExpired) {
+		respondWithErrorCode(w, http.StatusUnauthorized, "refresh_token_expired", "Refresh token has expired, log in again")
+		return
+	}
+	if errors.Is(err, database.ErrNotExist) {
 		respondWithError(w, http.StatusUnauthorized, "Invalid token")
 		return
 	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't refresh token")
+		return
+	}
 
-	secondAccessToken, err := auth.CreateJWT(cfg.jwtSecret, userID, defaultExpireInSecond)
+	secondAccessToken, err := auth.CreateJWT(cfg.jwtKeys, session.UserID, defaultExpireInSecond)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Error creating token")
 		return
 	}
 
 	resp := AccessToken{
-		Token: secondAccessToken,
+		Token:        secondAccessToken,
+		RefreshToken: newRefreshToken,
 	}
 	respondWithJSON(w, 200, resp)
 }
@@ -43,11 +73,38 @@ func (cfg *apiConfig) revokeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	revokeTokenOk := cfg.DB.RevokeRefreshToken(tokenString)
-	if !revokeTokenOk {
+	err = cfg.DB.RevokeRefreshToken(tokenString)
+	if errors.Is(err, database.ErrNotExist) {
 		respondWithError(w, http.StatusUnauthorized, "Invalid token")
 		return
 	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke token")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeEverywhereHandler logs the user of the refresh token out on
+// every device, closing all of their sessions
+func (cfg *apiConfig) revokeEverywhereHandler(w http.ResponseWriter, r *http.Request) {
+	tokenString, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, fmt.Sprintf("Cannot find JWT: %v", err))
+		return
+	}
+
+	_, err = cfg.DB.RevokeAllRefreshTokens(tokenString)
+	if errors.Is(err, database.ErrNotExist) {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke tokens")
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusNoContent)
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hale-pretty/chirpy/database"
+	"github.com/hale-pretty/chirpy/internal/auth"
+)
+
+type SessionResponse struct {
+	ID         int       `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+}
+
+// the device a request comes from, as recorded in its session
+func sessionClient(r *http.Request) database.SessionClient {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return database.SessionClient{UserAgent: r.UserAgent(), IP: ip}
+}
+
+func (cfg *apiConfig) getSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	// 1. Check authorization
+	tokenString, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, fmt.Sprintf("Cannot find JWT: %v", err))
+		return
+	}
+	// Parse and validate the JWT
+	userIDStr, err := auth.ValidateJWT(tokenString, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, fmt.Sprintf("Cannot validate JWT: %v", err))
+		return
+	}
+	userID, _ := strconv.Atoi(userIDStr)
+
+	// 2. List the sessions of the user, never their token hashes
+	sessions := []SessionResponse{}
+	for _, session := range cfg.DB.GetSessions(userID) {
+		sessions = append(sessions, SessionResponse{
+			ID:         session.ID,
+			CreatedAt:  session.CreatedAt,
+			LastUsedAt: session.LastUsedAt,
+			ExpiresAt:  session.ExpiresAt,
+			UserAgent:  session.UserAgent,
+			IP:         session.IP,
+		})
+	}
+	respondWithJSON(w, http.StatusOK, sessions)
+}
+
+func (cfg *apiConfig) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	// 1. Check authorization
+	tokenString, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, fmt.Sprintf("Cannot find JWT: %v", err))
+		return
+	}
+	// Parse and validate the JWT
+	userIDStr, err := auth.ValidateJWT(tokenString, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, fmt.Sprintf("Cannot validate JWT: %v", err))
+		return
+	}
+	userID, _ := strconv.Atoi(userIDStr)
+
+	// 2. Get session id
+	sessionID, err := strconv.Atoi(r.PathValue("sessionID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid path: %v", err))
+		return
+	}
+
+	// 3. Close the session, other users' sessions are not found
+	err = cfg.DB.RevokeSession(userID, sessionID)
+	if errors.Is(err, database.ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "Session not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke session")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNoContent)
+}
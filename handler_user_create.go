@@ -24,6 +24,7 @@ func (cfg *apiConfig) createUsersHandler(w http.ResponseWriter, r *http.Request)
 	userWoPW, err := cfg.DB.CreateUser(userRequest.Email, userRequest.Password)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 	respondWithJSON(w, 201, userWoPW)
 }
@@ -2,10 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 
+	"github.com/hale-pretty/chirpy/database"
 	"github.com/hale-pretty/chirpy/internal/auth"
 )
 
@@ -17,7 +19,7 @@ func (cfg *apiConfig) updateUsersHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	// Parse and validate the JWT
-	userIDStr, err := auth.ValidateJWT(tokenString, cfg.jwtSecret)
+	userIDStr, err := auth.ValidateJWT(tokenString, cfg.jwtKeys)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, fmt.Sprintf("Cannot validate JWT: %v", err))
 		return
@@ -35,9 +37,18 @@ func (cfg *apiConfig) updateUsersHandler(w http.ResponseWriter, r *http.Request)
 	}
 
 	// 3. Update info to database
-	resp, ok := cfg.DB.UpdateUser(userID, userRequest.Email, userRequest.Password)
-	if !ok {
-		http.Error(w, "User is not found", http.StatusUnauthorized)
+	resp, err := cfg.DB.UpdateUser(userID, userRequest.Email, userRequest.Password)
+	if err != nil {
+		if errors.Is(err, database.ErrEmailTaken) {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if errors.Is(err, database.ErrNotExist) {
+			http.Error(w, "User is not found", http.StatusUnauthorized)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update user")
+		return
 	}
 	respondWithJSON(w, 200, resp)
 }
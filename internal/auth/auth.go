@@ -4,7 +4,6 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
-	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
@@ -13,7 +12,8 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func CreateJWT(secret string, userID, expiresInSeconds int) (string, error) {
+// CreateJWT signs an access token for userID with the active key of keys
+func CreateJWT(keys *Keyring, userID, expiresInSeconds int) (string, error) {
 	userIDstr := strconv.Itoa(userID)
 	claims := jwt.RegisteredClaims{
 		Issuer:    "chirpy",
@@ -22,9 +22,7 @@ func CreateJWT(secret string, userID, expiresInSeconds int) (string, error) {
 		Subject:   userIDstr,
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	tokenString, err := token.SignedString([]byte(secret))
+	tokenString, err := keys.sign(claims)
 	if err != nil {
 		return "", err
 	}
@@ -32,15 +30,9 @@ func CreateJWT(secret string, userID, expiresInSeconds int) (string, error) {
 	return tokenString, nil
 }
 
-// Validate JWT
-func ValidateJWT(tokenString, jwtSecret string) (string, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &jwt.RegisteredClaims{}, func(token *jwt.Token) (interface{}, error) {
-		// Validate the alg is what you expect
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(jwtSecret), nil
-	})
+// Validate JWT against the key of keys named by its kid header
+func ValidateJWT(tokenString string, keys *Keyring) (string, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &jwt.RegisteredClaims{}, keys.verificationKey)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,241 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// smallest RSA modulus accepted for signing or verifying tokens
+const minRSABits = 2048
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// Keyring holds the keys access tokens are signed and verified with.
+// Tokens are signed by the active key and carry its id in the kid
+// header. The other keys are retiring: they only verify the tokens
+// they signed before the rotation, until those expire.
+type Keyring struct {
+	active string
+	keys   map[string]*signingKey
+	// HS256 secret, for deployments without asymmetric keys and for
+	// tokens signed before they were introduced
+	secret []byte
+	// next to keys, tokens signed with secret verify until then
+	secretUntil time.Time
+}
+
+type signingKey struct {
+	id     string
+	method jwt.SigningMethod
+	// nil for keys only kept to verify tokens
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+// JWK is the public half of a signing key as a JSON Web Key
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// Ed25519
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+}
+
+// JWKSet is the document served to services verifying access tokens
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// LoadKeyring loads the PEM encoded keys in dir, each named after its
+// key id: <kid>.pem. Private keys may be Ed25519 or RSA, in PKCS#8 or
+// (RSA only) PKCS#1 form; a public key verifies tokens but cannot sign
+// them. activeKID picks the signing key and may be empty if dir holds
+// a single private key. Without dir, tokens are signed with secret.
+// With dir, tokens signed with secret are only accepted before
+// secretUntil, to let them expire after switching to keys; the zero
+// time rejects them right away.
+func LoadKeyring(dir, activeKID, secret string, secretUntil time.Time) (*Keyring, error) {
+	keyring := &Keyring{
+		keys:   make(map[string]*signingKey),
+		secret: []byte(secret),
+	}
+	if dir == "" {
+		if secret == "" {
+			return nil, errors.New("no JWT signing keys and no JWT secret")
+		}
+		return keyring, nil
+	}
+	keyring.secretUntil = secretUntil
+	if secretUntil.IsZero() {
+		keyring.secret = nil
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	signers := []string{}
+	for _, path := range paths {
+		kid := strings.TrimSuffix(filepath.Base(path), ".pem")
+		key, err := loadKey(path, kid)
+		if err != nil {
+			return nil, fmt.Errorf("JWT key %s: %w", path, err)
+		}
+		keyring.keys[kid] = key
+		if key.private != nil {
+			signers = append(signers, kid)
+		}
+	}
+	switch {
+	case activeKID != "":
+		key, ok := keyring.keys[activeKID]
+		if !ok {
+			return nil, fmt.Errorf("active JWT key %q is not in %s", activeKID, dir)
+		}
+		if key.private == nil {
+			return nil, fmt.Errorf("active JWT key %q is a public key", activeKID)
+		}
+		keyring.active = activeKID
+	case len(signers) == 1:
+		keyring.active = signers[0]
+	case len(signers) == 0:
+		return nil, fmt.Errorf("no private JWT keys in %s", dir)
+	default:
+		return nil, fmt.Errorf("%d private JWT keys in %s, pick the active one", len(signers), dir)
+	}
+	return keyring, nil
+}
+
+func loadKey(path, kid string) (*signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+	var parsed any
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &signingKey{id: kid}
+	if signer, ok := parsed.(crypto.Signer); ok {
+		key.private = signer
+		key.public = signer.Public()
+	} else {
+		key.public = parsed
+	}
+	switch public := key.public.(type) {
+	case ed25519.PublicKey:
+		key.method = jwt.SigningMethodEdDSA
+	case *rsa.PublicKey:
+		if public.N.BitLen() < minRSABits {
+			return nil, fmt.Errorf("RSA key of %d bits, need at least %d", public.N.BitLen(), minRSABits)
+		}
+		key.method = jwt.SigningMethodRS256
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key.public)
+	}
+	return key, nil
+}
+
+// JWKS returns the public keys of the keyring, active key first. The
+// HS256 secret is never published.
+func (k *Keyring) JWKS() JWKSet {
+	kids := make([]string, 0, len(k.keys))
+	for kid := range k.keys {
+		kids = append(kids, kid)
+	}
+	sort.Slice(kids, func(i, j int) bool {
+		if (kids[i] == k.active) != (kids[j] == k.active) {
+			return kids[i] == k.active
+		}
+		return kids[i] < kids[j]
+	})
+	set := JWKSet{Keys: []JWK{}}
+	for _, kid := range kids {
+		set.Keys = append(set.Keys, k.keys[kid].jwk())
+	}
+	return set
+}
+
+func (key *signingKey) jwk() JWK {
+	jwk := JWK{KeyID: key.id, Use: "sig", Algorithm: key.method.Alg()}
+	switch public := key.public.(type) {
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	}
+	return jwk
+}
+
+// sign claims with the active key, or the secret without one
+func (k *Keyring) sign(claims jwt.Claims) (string, error) {
+	if k.active == "" {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(k.secret)
+	}
+	key := k.keys[k.active]
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.id
+	return token.SignedString(key.private)
+}
+
+// the key that verifies token: the one named by its kid header, or the
+// secret for tokens without one while it is accepted. The algorithm
+// has to be the key's, so a public key is never mistaken for an HMAC
+// secret.
+func (k *Keyring) verificationKey(token *jwt.Token) (any, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok || len(k.secret) == 0 {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		if k.active != "" && !time.Now().Before(k.secretUntil) {
+			return nil, errors.New("tokens signed with the JWT secret are no longer accepted")
+		}
+		return k.secret, nil
+	}
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.public, nil
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// write a fresh Ed25519 key named kid into a new directory
+func keyDir(t *testing.T, kid string) string {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	block := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, kid+".pem"), block, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestSecretTokensNextToKeys(t *testing.T) {
+	secretOnly, err := LoadKeyring("", "", "secret", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs256, err := CreateJWT(secretOnly, 1, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := keyDir(t, "key-1")
+
+	for _, tt := range []struct {
+		name        string
+		secretUntil time.Time
+		valid       bool
+	}{
+		{"not accepted", time.Time{}, false},
+		{"accepted until later", time.Now().Add(time.Hour), true},
+		{"accepted until earlier", time.Now().Add(-time.Second), false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := LoadKeyring(dir, "", "secret", tt.secretUntil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = ValidateJWT(hs256, keys)
+			if (err == nil) != tt.valid {
+				t.Errorf("ValidateJWT = %v, want valid %v", err, tt.valid)
+			}
+			// tokens signed by the key are valid either way
+			signed, err := CreateJWT(keys, 1, 60)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ValidateJWT(signed, keys); err != nil {
+				t.Errorf("ValidateJWT of a key signed token = %v", err)
+			}
+		})
+	}
+}
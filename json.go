@@ -7,13 +7,20 @@ import (
 )
 
 func respondWithError(w http.ResponseWriter, code int, msg string) {
+	respondWithErrorCode(w, code, "", msg)
+}
+
+// respondWithErrorCode adds errCode to the error response, for errors
+// clients have to tell apart from others with the same status
+func respondWithErrorCode(w http.ResponseWriter, code int, errCode, msg string) {
 	type errorResponse struct {
 		Error string `json:"error"`
+		Code  string `json:"code,omitempty"`
 	}
 	if code > 499 {
 		log.Printf("Responding with 5XX error: %s", msg)
 	}
-	errResp := errorResponse{Error: msg}
+	errResp := errorResponse{Error: msg, Code: errCode}
 	respondWithJSON(w, code, errResp)
 }
 
@@ -1,38 +1,47 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
+	"sync/atomic"
+	"time"
 
 	"github.com/hale-pretty/chirpy/database"
+	"github.com/hale-pretty/chirpy/internal/auth"
 	"github.com/joho/godotenv"
 )
 
 type apiConfig struct {
-	fileserverHits int
-	DB             *database.DB
-	jwtSecret      string
-	polkaAPIKey    string
+	fileserverHits atomic.Int64
+	DB             database.Store
+	fileDB         *database.DB
+	jwtKeys        *auth.Keyring
+	// how long the refresh tokens handed out last
+	refreshTokenTTL time.Duration
+	polkaAPIKey     string
+	adminAPIKey     string
+	audit           *auditLog
+	// nil unless the server replicates another one
+	replica *replica
 }
 
 var defaultExpireInSecond int
 
 func main() {
-	// create database
-	db, err := database.NewDB("database.json")
-	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+	if len(os.Args) > 1 && os.Args[1] == "db" {
+		os.Exit(runDBCommand(os.Args[2:]))
 	}
 
-	// load JWT_SECRET
-	err = godotenv.Load()
+	// load the JWT signing keys
+	err := godotenv.Load()
 	if err != nil {
 		log.Fatalf("Error loading .env file")
 	}
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		log.Fatal("JWT_SECRET environment variable is not set")
+	jwtKeys, err := jwtKeyringFromEnv()
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	// load POLKA_API_KEY
@@ -44,22 +53,94 @@ func main() {
 	if polkaAPIKey == "" {
 		log.Fatal("POLKA_KEY environment variable is not set")
 	}
+	// ADMIN_API_KEY enables the admin data endpoints
+	adminAPIKey := os.Getenv("ADMIN_API_KEY")
 	// set default expiration time for access token
 	defaultExpireInSecond = 3600
+	refreshTokenTTL, err := refreshTokenTTLFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// create database, CHIRPY_STORE=memory keeps everything in memory
+	var store database.Store
+	var fileDB *database.DB
+	if os.Getenv("CHIRPY_STORE") == "memory" {
+		store = database.NewMemStore()
+	} else {
+		opts, err := databaseOptionsFromEnv()
+		if err != nil {
+			log.Fatal(err)
+		}
+		// replicas receive the primary's removals with its changes
+		if os.Getenv("CHIRPY_REPLICA_OF") != "" {
+			opts.RetentionInterval = -1
+		}
+		fileDB, err = database.NewDBWithOptions(defaultDBPath, opts)
+		if err != nil {
+			log.Fatalf("Failed to initialize database: %v", err)
+		}
+		defer fileDB.Close()
+		store = fileDB
+	}
+
+	// CHIRPY_AUDIT_LOG is where security events are appended
+	auditPath := os.Getenv("CHIRPY_AUDIT_LOG")
+	if auditPath == "" {
+		auditPath = defaultAuditLogPath
+	}
+	audit, err := openAuditLog(auditPath)
+	if err != nil {
+		log.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer audit.Close()
 
 	// create mux
 	mux := http.NewServeMux()
-	apiCfg := apiConfig{
-		fileserverHits: 0,
-		DB:             db,
-		jwtSecret:      jwtSecret,
-		polkaAPIKey:    polkaAPIKey,
+	apiCfg := &apiConfig{
+		DB:              store,
+		fileDB:          fileDB,
+		jwtKeys:         jwtKeys,
+		refreshTokenTTL: refreshTokenTTL,
+		polkaAPIKey:     polkaAPIKey,
+		adminAPIKey:     adminAPIKey,
+		audit:           audit,
+	}
+
+	// CHIRPY_REPLICA_OF makes this server a read replica of that primary
+	if primary := os.Getenv("CHIRPY_REPLICA_OF"); primary != "" {
+		if fileDB == nil {
+			log.Fatal("CHIRPY_REPLICA_OF needs the file database")
+		}
+		primaryAPIKey := os.Getenv("CHIRPY_PRIMARY_API_KEY")
+		if primaryAPIKey == "" {
+			primaryAPIKey = adminAPIKey
+		}
+		if primaryAPIKey == "" {
+			log.Fatal("CHIRPY_REPLICA_OF needs CHIRPY_PRIMARY_API_KEY or ADMIN_API_KEY")
+		}
+		rep, err := newReplica(primary, primaryAPIKey, fileDB)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ctx, stop := context.WithCancel(context.Background())
+		defer stop()
+		go rep.run(ctx)
+		apiCfg.replica = rep
+		log.Printf("Replicating %s", rep.primary)
 	}
 	fileServer := http.FileServer(http.Dir("."))
 
 	mux.Handle("/app/*", http.StripPrefix("/app", apiCfg.middlewareMetricsInc(fileServer)))
 	mux.HandleFunc("GET /admin/metrics", apiCfg.hitsHandler)
-	mux.HandleFunc("GET /api/healthz", readinessHandler)
+	mux.HandleFunc("GET /admin/export", apiCfg.exportHandler)
+	mux.HandleFunc("POST /admin/import", apiCfg.importHandler)
+	mux.HandleFunc("GET /admin/backup", apiCfg.backupHandler)
+	mux.HandleFunc("GET /admin/changes", apiCfg.changesHandler)
+	mux.HandleFunc("GET /admin/replication/changes", apiCfg.replicationChangesHandler)
+	mux.HandleFunc("POST /admin/retention", apiCfg.retentionHandler)
+	mux.HandleFunc("GET /api/healthz", apiCfg.readinessHandler)
+	mux.HandleFunc("GET /.well-known/jwks.json", apiCfg.jwksHandler)
 	mux.HandleFunc("/api/reset", apiCfg.resetHandler)
 	mux.HandleFunc("POST /api/chirps", apiCfg.createChirpHandler)
 	mux.HandleFunc("GET /api/chirps/{chirpID}", apiCfg.getChirpsByChirpIdHandler)
@@ -68,12 +149,19 @@ func main() {
 	mux.HandleFunc("PUT /api/users", apiCfg.updateUsersHandler)
 	mux.HandleFunc("POST /api/refresh", apiCfg.refreshHandler)
 	mux.HandleFunc("POST /api/revoke", apiCfg.revokeHandler)
+	mux.HandleFunc("POST /api/revoke/everywhere", apiCfg.revokeEverywhereHandler)
+	mux.HandleFunc("GET /api/sessions", apiCfg.getSessionsHandler)
+	mux.HandleFunc("DELETE /api/sessions/{sessionID}", apiCfg.deleteSessionHandler)
 	mux.HandleFunc("DELETE /api/chirps/{chirpID}", apiCfg.deleteChirpHandler)
 	mux.HandleFunc("POST /api/polka/webhooks", apiCfg.polkaWebhooksHandler)
+	addr := os.Getenv("CHIRPY_ADDR")
+	if addr == "" {
+		addr = "localhost:8080"
+	}
 	server := &http.Server{
-		Addr:    "localhost:8080",
-		Handler: mux,
+		Addr:    addr,
+		Handler: apiCfg.middlewareReplica(mux),
 	}
-	log.Println("Running server at 8080")
+	log.Printf("Running server at %s", addr)
 	server.ListenAndServe()
 }
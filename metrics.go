@@ -3,11 +3,12 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strings"
 )
 
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cfg.fileserverHits++
+		cfg.fileserverHits.Add(1)
 		next.ServeHTTP(w, r)
 	})
 }
@@ -21,8 +22,32 @@ func (cfg *apiConfig) hitsHandler(w http.ResponseWriter, r *http.Request) {
 		<body>
 			<h1>Welcome, Chirpy Admin</h1>
 			<p>Chirpy has been visited %d times!</p>
+			%s
 		</body>
 
-		</html>`, cfg.fileserverHits)
+		</html>`, cfg.fileserverHits.Load(), cfg.commitStatsHTML())
 	w.Write([]byte(html))
 }
+
+// group commit metrics of the file database
+func (cfg *apiConfig) commitStatsHTML() string {
+	if cfg.fileDB == nil {
+		return ""
+	}
+	stats := cfg.fileDB.CommitStats()
+	average := 0.0
+	if stats.Batches > 0 {
+		average = float64(stats.Transactions) / float64(stats.Batches)
+	}
+	var sizes strings.Builder
+	for i, count := range stats.BatchSizes {
+		label := fmt.Sprintf("%d-%d", 1<<i, 1<<(i+1)-1)
+		if i == len(stats.BatchSizes)-1 {
+			label = fmt.Sprintf("%d+", 1<<i)
+		}
+		fmt.Fprintf(&sizes, "<li>%s: %d</li>", label, count)
+	}
+	return fmt.Sprintf(`<h2>Group commit</h2>
+			<p>%d transactions in %d batches, %.2f per batch on average, largest batch %d</p>
+			<ul>%s</ul>`, stats.Transactions, stats.Batches, average, stats.LargestBatch, sizes.String())
+}
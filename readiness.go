@@ -1,9 +1,40 @@
 package main
 
-import "net/http"
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
 
-func readinessHandler(w http.ResponseWriter, r *http.Request) {
+// readinessHandler answers OK, replicas add their replication lag and
+// answer 503 until they have caught up with the primary once
+func (cfg *apiConfig) readinessHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
+	if cfg.replica == nil {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+		return
+	}
+	status := cfg.replica.status()
+	var body strings.Builder
+	code := http.StatusOK
+	if status.Synced {
+		body.WriteString("OK\n")
+	} else {
+		code = http.StatusServiceUnavailable
+		body.WriteString("SYNCING\n")
+	}
+	fmt.Fprintf(&body, "replica of %s\n", status.Primary)
+	fmt.Fprintf(&body, "lag: %d changes (applied %d of %d)\n", status.PrimaryLatest-status.Applied, status.Applied, status.PrimaryLatest)
+	if status.LastContact.IsZero() {
+		body.WriteString("last contact: never\n")
+	} else {
+		fmt.Fprintf(&body, "last contact: %s ago\n", time.Since(status.LastContact).Round(time.Millisecond))
+	}
+	if status.LastErr != nil {
+		fmt.Fprintf(&body, "last error: %v\n", status.LastErr)
+	}
+	w.WriteHeader(code)
+	w.Write([]byte(body.String()))
 }
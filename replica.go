@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hale-pretty/chirpy/database"
+)
+
+const (
+	// how long one poll of the primary's change feed waits for changes
+	replicaPollWait = 30 * time.Second
+	// longest a bootstrap may take to download the primary's backup
+	replicaBootstrapTimeout = 5 * time.Minute
+	replicaRetryMin         = time.Second
+	replicaRetryMax         = 30 * time.Second
+)
+
+// replica keeps the local database a copy of a primary chirpy
+// instance. It bootstraps from the primary's /admin/backup, then long
+// polls /admin/replication/changes and applies every change locally,
+// secrets included. Writes never
+// reach it, middlewareReplica sends them to the primary.
+type replica struct {
+	primary string
+	apiKey  string
+	db      *database.DB
+	client  *http.Client
+
+	mu           sync.Mutex
+	bootstrapped bool
+	// whether the local database has caught up with the primary once
+	synced        bool
+	primaryLatest int64
+	lastContact   time.Time
+	lastErr       error
+}
+
+// replicaStatus is what the health output reports about a replica
+type replicaStatus struct {
+	Primary       string
+	Synced        bool
+	Applied       int64
+	PrimaryLatest int64
+	LastContact   time.Time
+	LastErr       error
+}
+
+func newReplica(primary, apiKey string, db *database.DB) (*replica, error) {
+	u, err := url.Parse(primary)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid primary URL %q", primary)
+	}
+	return &replica{
+		primary: strings.TrimSuffix(primary, "/"),
+		apiKey:  apiKey,
+		db:      db,
+		client:  &http.Client{},
+	}, nil
+}
+
+// follow the primary until ctx is done, backing off while it fails
+func (rep *replica) run(ctx context.Context) {
+	retry := replicaRetryMin
+	for ctx.Err() == nil {
+		err := rep.poll(ctx)
+		if err == nil {
+			retry = replicaRetryMin
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		rep.mu.Lock()
+		rep.lastErr = err
+		rep.mu.Unlock()
+		log.Printf("replica: %v, retrying in %s", err, retry)
+		select {
+		case <-time.After(retry):
+		case <-ctx.Done():
+			return
+		}
+		retry = min(retry*2, replicaRetryMax)
+	}
+}
+
+// wait for the next page of changes and apply it, bootstrapping first
+// when the local database does not follow the primary yet
+func (rep *replica) poll(ctx context.Context) error {
+	since := rep.db.ChangeSeq()
+	rep.mu.Lock()
+	bootstrapped := rep.bootstrapped
+	rep.mu.Unlock()
+	// a fresh database has nothing to resume from
+	if since == 0 && !bootstrapped {
+		return rep.bootstrap(ctx)
+	}
+
+	pollCtx, cancel := context.WithTimeout(ctx, replicaPollWait+10*time.Second)
+	defer cancel()
+	query := url.Values{}
+	query.Set("since", strconv.FormatInt(since, 10))
+	query.Set("wait", replicaPollWait.String())
+	resp, err := rep.get(pollCtx, "/admin/replication/changes?"+query.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		log.Printf("replica: primary no longer has changes after %d, bootstrapping again", since)
+		return rep.bootstrap(ctx)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return responseError("changes", resp)
+	}
+	page := database.ChangePage{}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return fmt.Errorf("cannot decode changes: %w", err)
+	}
+	// the primary was restored to an older state
+	if page.Latest < since {
+		log.Printf("replica: primary is at change %d, behind our %d, bootstrapping again", page.Latest, since)
+		return rep.bootstrap(ctx)
+	}
+	err = rep.db.ApplyChanges(page.Changes)
+	if errors.Is(err, database.ErrChangeGap) {
+		log.Printf("replica: %v, bootstrapping again", err)
+		return rep.bootstrap(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot apply changes: %w", err)
+	}
+	rep.contacted(page.Latest)
+	return nil
+}
+
+// replace the local database with the primary's backup
+func (rep *replica) bootstrap(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, replicaBootstrapTimeout)
+	defer cancel()
+	resp, err := rep.get(ctx, "/admin/backup")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError("backup", resp)
+	}
+	if err := rep.db.Restore(resp.Body); err != nil {
+		return fmt.Errorf("cannot restore the primary's backup: %w", err)
+	}
+	applied := rep.db.ChangeSeq()
+	log.Printf("replica: bootstrapped from %s at change %d", rep.primary, applied)
+	rep.mu.Lock()
+	rep.bootstrapped = true
+	rep.mu.Unlock()
+	rep.contacted(applied)
+	return nil
+}
+
+func (rep *replica) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rep.primary+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "ApiKey "+rep.apiKey)
+	return rep.client.Do(req)
+}
+
+// record a successful exchange with the primary
+func (rep *replica) contacted(primaryLatest int64) {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	rep.primaryLatest = primaryLatest
+	rep.lastContact = time.Now()
+	rep.lastErr = nil
+	if rep.db.ChangeSeq() >= primaryLatest {
+		rep.synced = true
+	}
+}
+
+func (rep *replica) status() replicaStatus {
+	applied := rep.db.ChangeSeq()
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	return replicaStatus{
+		Primary:       rep.primary,
+		Synced:        rep.synced,
+		Applied:       applied,
+		PrimaryLatest: max(rep.primaryLatest, applied),
+		LastContact:   rep.lastContact,
+		LastErr:       rep.lastErr,
+	}
+}
+
+func responseError(what string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("primary answered %s with %s: %s", what, resp.Status, strings.TrimSpace(string(body)))
+}
+
+// middlewareReplica sends every request that may write to the primary
+// with a redirect that keeps the method and body, replicas only serve
+// reads
+func (cfg *apiConfig) middlewareReplica(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.replica == nil || r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		http.Redirect(w, r, cfg.replica.primary+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	})
+}